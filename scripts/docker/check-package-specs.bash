@@ -0,0 +1,33 @@
+#!/bin/bash
+
+set -eu
+set -o pipefail
+
+# The nats-v2-migrate package only ships the source files its spec lists, so
+# every package the binaries import, vendored or not, has to be listed there.
+# This compares the spec with `go list -deps` and prints the lines to add or
+# remove.
+
+REPO_PATH="$( cd "$( dirname "${BASH_SOURCE[0]}" )/../.." >/dev/null 2>&1 && pwd )"
+SPEC="${REPO_PATH}/packages/nats-v2-migrate/spec"
+
+function expected_files() {
+  pushd "${REPO_PATH}/src/code.cloudfoundry.org" > /dev/null
+  GOOS=linux GOFLAGS=-mod=vendor go list -deps -f '{{if not .Standard}}{{.ImportPath}}{{end}}' ./nats-v2-migrate/... | sort -u | while read -r package; do
+    local dir="vendor/${package}"
+    if [[ "${package}" == code.cloudfoundry.org/nats-v2-migrate* ]]; then
+      dir="${package#code.cloudfoundry.org/}"
+    fi
+
+    echo "  - code.cloudfoundry.org/${dir}/*.go # gosub"
+    if compgen -G "${dir}/*.s" > /dev/null; then
+      echo "  - code.cloudfoundry.org/${dir}/*.s # gosub"
+    fi
+  done
+  popd > /dev/null
+}
+
+if ! diff -u <(grep '# gosub$' "${SPEC}") <(expected_files); then
+  echo "${SPEC} does not list the packages nats-v2-migrate is built from" >&2
+  exit 1
+fi
@@ -10,5 +10,6 @@ REPO_NAME=$(git_get_remote_name)
 "${THIS_FILE_DIR}/create-docker-container.bash" -d
 
 docker exec $REPO_NAME-docker-container '/repo/scripts/docker/tests-templates.bash'
+docker exec $REPO_NAME-docker-container '/repo/scripts/docker/check-package-specs.bash'
 docker exec $REPO_NAME-docker-container '/repo/scripts/docker/test.bash' "$@"
 docker exec $REPO_NAME-docker-container '/repo/scripts/docker/lint.bash'
@@ -33,6 +33,7 @@ module Bosh::Template::Test
               'nats' => {
                 'hostname' => 'nats.service.cf.internal',
                 'port' => 4224,
+                'cluster_port' => 4225,
               }
             }
           )
@@ -61,22 +62,122 @@ expected_template =  %{
     "address": "bbc790.nats.service.cf.internal",
     "nats_instances": [ "abc1234.nats.service.cf.internal:4224", "def456.nats.service.cf.internal:4224", "bbc790.nats.service.cf.internal:4224" ],
     "nats_port": 4224,
+    "nats_monitor_port": 0,
+    "nats_cluster_port": 4225,
     "nats_migrate_port": 4243,
     "nats_v1_bin_path": "/var/vcap/packages/gnatsd/bin/gnatsd",
     "nats_v2_bin_path": "/var/vcap/packages/nats-server/bin/nats-server",
     "nats_config_path": "/var/vcap/jobs/nats-tls/config/nats-tls.conf",
     "nats_migrate_servers": [ "https://abc1234.nats.service.cf.internal:4243", "https://def456.nats.service.cf.internal:4243", "https://bbc790.nats.service.cf.internal:4243" ],
     "nats_internal_tls_enabled": true,
+    "nats_internal_tls_ca_file": "/var/vcap/jobs/nats-tls/config/internal_tls/ca.pem",
+    "nats_internal_tls_cert_file": "/var/vcap/jobs/nats-tls/config/internal_tls/certificate.pem",
+    "nats_internal_tls_key_file": "/var/vcap/jobs/nats-tls/config/internal_tls/private_key.pem",
     "nats_migrate_server_ca_file": "/var/vcap/jobs/nats-tls/config/external_tls/ca.pem",
     "nats_migrate_server_cert_file": "/var/vcap/jobs/nats-tls/config/external_tls/certificate.pem",
     "nats_migrate_server_key_file": "/var/vcap/jobs/nats-tls/config/external_tls/private_key.pem",
     "nats_migrate_client_ca_file": "/var/vcap/jobs/nats-tls/config/client_tls/ca.pem",
     "nats_migrate_client_cert_file": "/var/vcap/jobs/nats-tls/config/client_tls/certificate.pem",
-    "nats_migrate_client_key_file": "/var/vcap/jobs/nats-tls/config/client_tls/private_key.pem"
+    "nats_migrate_client_key_file": "/var/vcap/jobs/nats-tls/config/client_tls/private_key.pem",
+    "nats_tls_ca_file": "/var/vcap/jobs/nats-tls/config/external_tls/ca.pem",
+    "nats_tls_cert_file": "/var/vcap/jobs/nats-tls/config/client_tls/certificate.pem",
+    "nats_tls_key_file": "/var/vcap/jobs/nats-tls/config/client_tls/private_key.pem",
+    "nats_tls_server_name": "nats.service.cf.internal",
+    "nats_user": "",
+    "nats_password": "",
+    "nats_required_version": "",
+    "nats_lame_duck_duration": "30s",
+    "nats_lame_duck_grace_period": "5s",
+    "nats_readiness_timeout": "60s",
+    "nats_state_file": "/var/vcap/data/nats-tls/migration-state.json",
+    "nats_binary_override": "",
+    "nats_binary_quorum": "all-reachable",
+    "nats_binary_min_responses": 0,
+    "nats_binary_quorum_timeout": "0s",
+    "nats_migrate_authorized_clients": {},
+    "nats_metrics_port": 0,
+    "nats_embedded": false,
+    "nats_mem_limit_alert": "500 MB",
+    "nats_mem_limit_restart": "3000 MB",
+    "nats_log_passthrough": false,
+    "nats_pid_file": "/var/vcap/data/nats-tls/nats-server.pid",
+    "nats_orphan_policy": "terminate"
 }
 }
             expect(rendered_template).to include(expected_template)
           end
+
+          describe 'credentials' do
+            before do
+              merged_manifest_properties['nats']['user'] = 'user-with-"quotes"'
+              merged_manifest_properties['nats']['password'] = 'p@ss\\word'
+            end
+
+            it 'renders the credentials for the probes' do
+              rendered_template = JSON.parse(template.render(merged_manifest_properties, consumes: links, spec: spec))
+              expect(rendered_template['nats_user']).to eq('user-with-"quotes"')
+              expect(rendered_template['nats_password']).to eq('p@ss\\word')
+            end
+          end
+
+          describe 'memory limits' do
+            %w[B KB MB GB %].each do |unit|
+              describe "set #{unit} limits" do
+                before do
+                  merged_manifest_properties['nats']['mem_limit'] = {
+                    'alert' => "100 #{unit}",
+                    'restart' => "200 #{unit}"
+                  }
+                end
+                it 'renders the limits' do
+                  rendered_template = JSON.parse(template.render(merged_manifest_properties, consumes: links, spec: spec))
+                  expect(rendered_template['nats_mem_limit_alert']).to eq("100 #{unit}")
+                  expect(rendered_template['nats_mem_limit_restart']).to eq("200 #{unit}")
+                end
+              end
+            end
+
+            describe 'set bad limit on alert' do
+              before do
+                merged_manifest_properties['nats']['mem_limit'] = { 'alert' => '100 potatoes' }
+              end
+              it 'raises an error' do
+                expect do
+                  template.render(merged_manifest_properties, consumes: links, spec: spec)
+                end.to raise_error(/Bad 'nats.mem_limit.alert' setting: 100 potatoes. Format is: <number> B|KB|MB|GB|%/)
+              end
+            end
+            describe 'set non-integer limit on alert' do
+              before do
+                merged_manifest_properties['nats']['mem_limit'] = { 'alert' => 'mashed potatoes' }
+              end
+              it 'raises an error' do
+                expect do
+                  template.render(merged_manifest_properties, consumes: links, spec: spec)
+                end.to raise_error(/Bad 'nats.mem_limit.alert' setting: mashed potatoes. Format is: <number> B|KB|MB|GB|%/)
+              end
+            end
+            describe 'set bad limit on restart' do
+              before do
+                merged_manifest_properties['nats']['mem_limit'] = { 'restart' => '100 potatoes' }
+              end
+              it 'raises an error' do
+                expect do
+                  template.render(merged_manifest_properties, consumes: links, spec: spec)
+                end.to raise_error(/Bad 'nats.mem_limit.restart' setting: 100 potatoes. Format is: <number> B|KB|MB|GB|%/)
+              end
+            end
+            describe 'set non-integer limit on restart' do
+              before do
+                merged_manifest_properties['nats']['mem_limit'] = { 'restart' => 'mashed potatoes' }
+              end
+              it 'raises an error' do
+                expect do
+                  template.render(merged_manifest_properties, consumes: links, spec: spec)
+                end.to raise_error(/Bad 'nats.mem_limit.restart' setting: mashed potatoes. Format is: <number> B|KB|MB|GB|%/)
+              end
+            end
+          end
         end
       end
     end
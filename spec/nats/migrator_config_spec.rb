@@ -11,6 +11,8 @@ module Bosh::Template::Test
       let(:merged_manifest_properties) do
         {
           'nats' => {
+            'user' => 'nats-user',
+            'password' => 'nats-password',
             'internal' => {
               'tls' => {
                 'enabled' => true,
@@ -33,6 +35,7 @@ module Bosh::Template::Test
               'nats' => {
                 'hostname' => 'nats.service.cf.internal',
                 'port' => 4222,
+                'cluster_port' => 4223,
               }
             }
           )
@@ -61,9 +64,14 @@ expected_template =  %{
     "address": "bbc790.nats.service.cf.internal",
     "nats_instances": [ "abc1234.nats.service.cf.internal:4222", "def456.nats.service.cf.internal:4222", "bbc790.nats.service.cf.internal:4222" ],
     "nats_port": 4222,
+    "nats_monitor_port": 0,
+    "nats_cluster_port": 4223,
     "nats_migrate_port": 4242,
     "nats_migrate_servers": [ "https://abc1234.nats.service.cf.internal:4242", "https://def456.nats.service.cf.internal:4242", "https://bbc790.nats.service.cf.internal:4242" ],
     "nats_internal_tls_enabled": true,
+    "nats_internal_tls_ca_file": "/var/vcap/jobs/nats/config/internal_tls/ca.pem",
+    "nats_internal_tls_cert_file": "/var/vcap/jobs/nats/config/internal_tls/certificate.pem",
+    "nats_internal_tls_key_file": "/var/vcap/jobs/nats/config/internal_tls/private_key.pem",
     "nats_migrate_server_ca_file": "/var/vcap/jobs/nats/config/migrate_server_tls/ca.pem",
     "nats_migrate_server_cert_file": "/var/vcap/jobs/nats/config/migrate_server_tls/certificate.pem",
     "nats_migrate_server_key_file": "/var/vcap/jobs/nats/config/migrate_server_tls/private_key.pem",
@@ -72,11 +80,53 @@ expected_template =  %{
     "nats_migrate_client_key_file": "/var/vcap/jobs/nats/config/migrate_client_tls/private_key.pem",
     "nats_v1_bin_path": "/var/vcap/packages/gnatsd/bin/gnatsd",
     "nats_v2_bin_path": "/var/vcap/packages/nats-server/bin/nats-server",
-    "nats_config_path": "/var/vcap/jobs/nats/config/nats.conf"
+    "nats_config_path": "/var/vcap/jobs/nats/config/nats.conf",
+    "nats_user": "nats-user",
+    "nats_password": "nats-password",
+    "nats_required_version": "",
+    "nats_lame_duck_duration": "30s",
+    "nats_lame_duck_grace_period": "5s",
+    "nats_readiness_timeout": "60s",
+    "nats_state_file": "/var/vcap/data/nats/migration-state.json",
+    "nats_binary_override": "",
+    "nats_binary_quorum": "all-reachable",
+    "nats_binary_min_responses": 0,
+    "nats_binary_quorum_timeout": "0s",
+    "nats_migrate_authorized_clients": {},
+    "nats_metrics_port": 0,
+    "nats_embedded": false,
+    "nats_log_passthrough": false,
+    "nats_pid_file": "/var/vcap/data/nats/nats-server.pid",
+    "nats_orphan_policy": "terminate"
 }
 }
             expect(rendered_template).to include(expected_template)
           end
+
+          describe 'credentials' do
+            before do
+              merged_manifest_properties['nats']['user'] = 'user-with-"quotes"'
+              merged_manifest_properties['nats']['password'] = 'p@ss\\word'
+            end
+
+            it 'renders the credentials nats requires for the probes' do
+              rendered_template = JSON.parse(template.render(merged_manifest_properties, consumes: links, spec: spec))
+              expect(rendered_template['nats_user']).to eq('user-with-"quotes"')
+              expect(rendered_template['nats_password']).to eq('p@ss\\word')
+            end
+          end
+
+          describe 'without credentials' do
+            before do
+              merged_manifest_properties['nats'].delete('user')
+            end
+
+            it 'raises an error' do
+              expect do
+                template.render(merged_manifest_properties, consumes: links, spec: spec)
+              end.to raise_error(/nats.user/)
+            end
+          end
         end
       end
     end
@@ -64,6 +64,8 @@ module Bosh::Template::Test
              'prof_port' => 0,
              'http' => '0.0.0.0:0',
              'write_deadline' => '2s',
+             'lame_duck_duration' => '30s',
+             'lame_duck_grace_period' => '5s',
              'debug' => false,
              'trace' => false,
              'logtime' => true,
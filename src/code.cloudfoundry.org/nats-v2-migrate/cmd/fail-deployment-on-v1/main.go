@@ -1,10 +1,12 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
 
+	"code.cloudfoundry.org/lager/v3"
 	"code.cloudfoundry.org/lager/v3/lagerflags"
 	"code.cloudfoundry.org/nats-v2-migrate/config"
 	"code.cloudfoundry.org/nats-v2-migrate/natsinfo"
@@ -33,15 +35,33 @@ func main() {
 		return
 	}
 
-	majorVersion, err := natsinfo.GetMajorVersion(fmt.Sprintf("%s:%d", cfg.Address, cfg.NATSPort))
+	prober, err := cfg.Prober()
+	if err != nil {
+		logger.Error("Failed to build NATS prober", err)
+		os.Exit(1)
+	}
+
+	serverInfo, err := prober.GetServerInfo(context.Background(), fmt.Sprintf("%s:%d", cfg.Address, cfg.NATSPort))
 	if err != nil {
 		logger.Error("Failed to connect to local NATS server", err, nil)
 		os.Exit(1)
 	}
-	logger.Info(fmt.Sprintf("Local nats server version: %d", majorVersion))
-	if majorVersion < 2 {
+	logger.Info(fmt.Sprintf("Local nats server version: %s", serverInfo.Version), lager.Data{"server_id": serverInfo.ServerID, "server_name": serverInfo.ServerName})
+	if serverInfo.SemVer.Major < 2 {
 		logger.Info("Local NATS server is on v1; exiting with error", nil)
 		os.Exit(1)
 	}
+
+	if cfg.NATSRequiredVersion != "" {
+		constraint, err := natsinfo.ParseConstraint(cfg.NATSRequiredVersion)
+		if err != nil {
+			logger.Error("Invalid required NATS version", err)
+			os.Exit(1)
+		}
+		if !constraint.Check(serverInfo.SemVer) {
+			logger.Info("Local NATS server does not satisfy the required version; exiting with error", lager.Data{"version": serverInfo.Version, "required_version": constraint.String()})
+			os.Exit(1)
+		}
+	}
 	logger.Info("Finished NATS v2 confirmation")
 }
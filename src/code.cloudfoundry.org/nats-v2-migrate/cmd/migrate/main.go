@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
@@ -17,15 +18,35 @@ import (
 	"code.cloudfoundry.org/lager/v3"
 	"code.cloudfoundry.org/lager/v3/lagerflags"
 	"code.cloudfoundry.org/nats-v2-migrate/config"
-	"code.cloudfoundry.org/nats-v2-migrate/natsinfo"
 )
 
+// MigrateRequest is the body of a /migrate call.
+type MigrateRequest struct {
+	Target string `json:"target"`
+}
+
 type MigrateServerResponse struct {
 	Bootstrap bool `json:"bootstrap"`
 }
 
+// MigrateServerStatus is the subset of the /status response of the migrate
+// server that is logged after a migration.
+type MigrateServerStatus struct {
+	Binary       string `json:"binary"`
+	Version      string `json:"version"`
+	Running      bool   `json:"running"`
+	PID          int    `json:"pid"`
+	Uptime       string `json:"uptime"`
+	Restarts     int    `json:"restarts"`
+	Migration    string `json:"migration"`
+	LastExitCode *int   `json:"last_exit_code"`
+}
+
 func main() {
 	configFilePath := flag.String("config-file", "", "path to config file")
+	showStatus := flag.Bool("status", false, "log the status of every nats node instead of migrating")
+	rollback := flag.Bool("rollback", false, "return every nats node to the binary before its current one instead of migrating")
+	targetName := flag.String("target", "", "name of the nats binary to migrate to, defaults to the newest")
 	flag.Parse()
 
 	var cfg config.Config
@@ -38,20 +59,69 @@ func main() {
 	logger, _ := lagerflags.NewFromConfig("nats-migrate", lagerflags.LagerConfig{LogLevel: lagerflags.INFO, TimeFormat: lagerflags.FormatRFC3339})
 	logger.Info("Starting migrate")
 
+	if *showStatus {
+		natsMigrateServerClient, err := newNATSMigrateServerClient(cfg.NATSMigrateClientCAFile, cfg.NATSMigrateClientCertFile, cfg.NATSMigrateClientKeyFile)
+		if err != nil {
+			logger.Error("Failed to create NATS migrate server client", err)
+			os.Exit(1)
+		}
+		if !logStatus(logger, natsMigrateServerClient, cfg.NATSMigrateServers) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *rollback {
+		natsMigrateServerClient, err := newNATSMigrateServerClient(cfg.NATSMigrateClientCAFile, cfg.NATSMigrateClientCertFile, cfg.NATSMigrateClientKeyFile)
+		if err != nil {
+			logger.Error("Failed to create NATS migrate server client", err)
+			os.Exit(1)
+		}
+		err = rollbackAll(logger, natsMigrateServerClient, cfg.NATSMigrateServers)
+		if err != nil {
+			logger.Error("Some nats instances failed to roll back.", err)
+			os.Exit(1)
+		}
+		logger.Info("Finished rollback")
+		return
+	}
+
 	if len(cfg.NATSMigrateServers) <= 1 {
 		logger.Info("Single instance NATs cluster. Skipping migration.")
 		return
 	}
 
-	majorVersion, err := natsinfo.GetMajorVersion(fmt.Sprintf("%s:%d", cfg.Address, cfg.NATSPort))
+	binaries, err := cfg.Binaries()
+	if err != nil {
+		logger.Error("Invalid nats binaries", err)
+		os.Exit(1)
+	}
+	target := binaries[binaries.Newest()]
+	if *targetName != "" {
+		i, ok := binaries.Find(*targetName)
+		if !ok {
+			logger.Error("Unknown migration target", fmt.Errorf("there is no nats binary called %s", *targetName))
+			os.Exit(1)
+		}
+		target = binaries[i]
+	}
+	logger.Info(fmt.Sprintf("Migrating to %s", target.Name), lager.Data{"version": target.Version})
+
+	prober, err := cfg.Prober()
+	if err != nil {
+		logger.Error("Failed to build NATS prober", err)
+		os.Exit(1)
+	}
+
+	serverInfo, err := prober.GetServerInfo(context.Background(), fmt.Sprintf("%s:%d", cfg.Address, cfg.NATSPort))
 	if err != nil {
 		logger.Error("Failed to connect to local NATS server", err, nil)
 		os.Exit(1)
 	}
-	logger.Info(fmt.Sprintf("Local nats server version: %d", majorVersion))
+	logger.Info(fmt.Sprintf("Local nats server version: %s", serverInfo.Version), lager.Data{"server_id": serverInfo.ServerID, "server_name": serverInfo.ServerName})
 
-	if majorVersion == 2 {
-		logger.Info("Local NATS instance has already been migrated to v2. Skipping migration.")
+	if target.Matches(serverInfo.SemVer) {
+		logger.Info(fmt.Sprintf("Local NATS instance already runs %s. Skipping migration.", target.Name))
 		return
 	}
 
@@ -97,7 +167,7 @@ func main() {
 	logger.Info("Migrating bootstrap server", lager.Data{"url": bootstrapMigrateServer})
 
 	for i := 0; i < retryCount; i++ {
-		err = PerformMigration(natsMigrateServerClient, bootstrapMigrateServer)
+		err = PerformMigration(natsMigrateServerClient, bootstrapMigrateServer, target.Name)
 		if err == nil {
 			break
 		}
@@ -137,7 +207,7 @@ func main() {
 
 			for i := 0; i < retryCount; i++ {
 				logger.Info(fmt.Sprintf("Try #%v", i))
-				err := PerformMigration(natsMigrateServerClient, serverUrl)
+				err := PerformMigration(natsMigrateServerClient, serverUrl, target.Name)
 				if err == nil {
 					logger.Info(fmt.Sprintf("Migration of %s completed successfully", serverUrl))
 					break
@@ -187,8 +257,95 @@ func CheckMigrationInfo(natsMigrateServerClient *http.Client, serverUrl string)
 	return &migrateServerResponse, nil
 }
 
-func PerformMigration(natsMigrateServerClient *http.Client, serverUrl string) error {
-	resp, err := natsMigrateServerClient.Post(serverUrl+"/migrate", "application/json", bytes.NewReader([]byte{}))
+func CheckStatus(natsMigrateServerClient *http.Client, serverUrl string) (*MigrateServerStatus, error) {
+	endpoint := fmt.Sprintf("%s/status", serverUrl)
+	resp, err := natsMigrateServerClient.Get(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to NATS migrate server %s. Connection error: %s", endpoint, err.Error())
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code from %s: %d", endpoint, resp.StatusCode)
+	}
+
+	var status MigrateServerStatus
+	err = json.NewDecoder(resp.Body).Decode(&status)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse status from NATS migrate server %s: %s", endpoint, err.Error())
+	}
+
+	return &status, nil
+}
+
+// logStatus logs where each node is, so that operators do not have to look
+// at every node. It reports whether all nodes answered.
+func logStatus(logger lager.Logger, natsMigrateServerClient *http.Client, serverUrls []string) bool {
+	ok := true
+	for _, serverUrl := range serverUrls {
+		status, err := CheckStatus(natsMigrateServerClient, serverUrl)
+		if err != nil {
+			logger.Error("Failed to get status", err, lager.Data{"url": serverUrl})
+			ok = false
+			continue
+		}
+		logger.Info("Status", lager.Data{"url": serverUrl, "status": status})
+	}
+	return ok
+}
+
+// rollbackAll asks every migrate server to return its nats to the binary
+// before its current one.
+func rollbackAll(logger lager.Logger, natsMigrateServerClient *http.Client, serverUrls []string) error {
+	wg := sync.WaitGroup{}
+	aggregateError := &AggregateError{}
+
+	for _, serverUrl := range serverUrls {
+		wg.Add(1)
+		go func(serverUrl string) {
+			defer wg.Done()
+			logger.Info("Rolling back server", lager.Data{"url": serverUrl})
+
+			err := PerformRollback(natsMigrateServerClient, serverUrl)
+			if err != nil {
+				logger.Error("Failed to roll back server", err, lager.Data{"url": serverUrl})
+				aggregateError.Append(err)
+				return
+			}
+			logger.Info(fmt.Sprintf("Rollback of %s completed successfully", serverUrl))
+		}(serverUrl)
+	}
+
+	wg.Wait()
+	if len(aggregateError.errors) > 0 {
+		return aggregateError
+	}
+	return nil
+}
+
+func PerformRollback(natsMigrateServerClient *http.Client, serverUrl string) error {
+	resp, err := natsMigrateServerClient.Post(serverUrl+"/rollback", "application/json", bytes.NewReader([]byte{}))
+	if err != nil {
+		return fmt.Errorf("Failed to roll back NATS server %s: %s", serverUrl, err.Error())
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Failed to roll back NATS server (Unexpected status code): %s, %v", serverUrl, resp.StatusCode)
+	}
+
+	return nil
+}
+
+// PerformMigration asks the migrate server at serverUrl to switch its nats to
+// the binary called target.
+func PerformMigration(natsMigrateServerClient *http.Client, serverUrl string, target string) error {
+	body, err := json.Marshal(MigrateRequest{Target: target})
+	if err != nil {
+		return err
+	}
+
+	resp, err := natsMigrateServerClient.Post(serverUrl+"/migrate", "application/json", bytes.NewReader(body))
 	if err != nil {
 		return fmt.Errorf("Failed to migrate NATS server %s: %s", serverUrl, err.Error())
 	}
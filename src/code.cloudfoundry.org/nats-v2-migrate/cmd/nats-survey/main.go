@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"code.cloudfoundry.org/nats-v2-migrate/config"
+	"code.cloudfoundry.org/nats-v2-migrate/natsinfo"
+)
+
+// Prints the version of every nats instance of the cluster, so operators can
+// see whether the cluster runs mixed versions.
+
+type SurveyReport struct {
+	Mixed     bool                    `json:"mixed"`
+	Instances []natsinfo.SurveyResult `json:"instances"`
+}
+
+func main() {
+	configFilePath := flag.String("config-file", "", "path to config file")
+	format := flag.String("format", "table", "output format: table or json")
+	workers := flag.Int("workers", 0, "number of instances to probe concurrently (default nats_probe_workers from the config file)")
+	flag.Parse()
+
+	cfg, err := config.NewConfig(*configFilePath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading config file: %v\n", err)
+		os.Exit(1)
+	}
+
+	prober, err := cfg.Prober()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error building NATS prober: %v\n", err)
+		os.Exit(1)
+	}
+
+	if *workers == 0 {
+		*workers = cfg.NATSProbeWorkers
+	}
+
+	results := prober.Survey(context.Background(), cfg.NATSInstances, *workers)
+	report := SurveyReport{
+		Mixed:     natsinfo.IsMixedVersion(results),
+		Instances: results,
+	}
+
+	switch *format {
+	case "json":
+		err = json.NewEncoder(os.Stdout).Encode(report)
+	case "table":
+		err = printTable(report)
+	default:
+		err = fmt.Errorf("unknown format %q", *format)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error printing survey: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func printTable(report SurveyReport) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "INSTANCE\tVERSION\tSERVER NAME\tLATENCY\tERROR")
+	for _, result := range report.Instances {
+		serverName := ""
+		if result.Info != nil {
+			serverName = result.Info.ServerName
+		}
+		errorColumn := ""
+		if result.Err != nil {
+			errorColumn = fmt.Sprintf("%s: %s", result.ErrorClass, result.Error)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n",
+			result.Instance,
+			orDash(result.Version),
+			orDash(serverName),
+			result.Latency.Round(time.Millisecond),
+			orDash(errorColumn),
+		)
+	}
+	err := w.Flush()
+	if err != nil {
+		return err
+	}
+
+	if report.Mixed {
+		fmt.Printf("\nThe cluster is running mixed versions: %s\n", strings.Join(versions(report.Instances), ", "))
+	}
+	return nil
+}
+
+func versions(results []natsinfo.SurveyResult) []string {
+	var versions []string
+	seen := map[string]bool{}
+	for _, result := range results {
+		if result.Version == "" || seen[result.Version] {
+			continue
+		}
+		seen[result.Version] = true
+		versions = append(versions, result.Version)
+	}
+	return versions
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
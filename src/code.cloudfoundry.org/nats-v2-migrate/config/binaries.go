@@ -0,0 +1,90 @@
+package config
+
+import (
+	"fmt"
+
+	"code.cloudfoundry.org/nats-v2-migrate/natsinfo"
+)
+
+const (
+	DefaultV1BinaryName = "v1"
+	DefaultV2BinaryName = "v2"
+)
+
+// NATSBinary is a nats build the wrapper can run. Version is the constraint
+// that the versions this build reports satisfy, e.g. ">=2.10.0 <2.11.0".
+type NATSBinary struct {
+	Name    string `json:"name"`
+	BinPath string `json:"bin_path"`
+	Version string `json:"version"`
+
+	constraint natsinfo.Constraint
+}
+
+// NATSBinaries is ordered from the oldest to the newest build.
+type NATSBinaries []NATSBinary
+
+// Binaries returns the configured nats_binaries. Without them, the binaries
+// are gnatsd as "v1" and nats-server as "v2" from the bin path settings.
+func (c Config) Binaries() (NATSBinaries, error) {
+	binaries := c.NATSBinaries
+	if len(binaries) == 0 {
+		binaries = NATSBinaries{
+			{Name: DefaultV1BinaryName, BinPath: c.NATSV1BinPath, Version: "<2"},
+			{Name: DefaultV2BinaryName, BinPath: c.NATSV2BinPath, Version: ">=2"},
+		}
+	}
+
+	seen := map[string]bool{}
+	parsed := make(NATSBinaries, 0, len(binaries))
+	for _, binary := range binaries {
+		if binary.Name == "" {
+			return nil, fmt.Errorf("nats binary with bin_path %q has no name", binary.BinPath)
+		}
+		if seen[binary.Name] {
+			return nil, fmt.Errorf("nats binary %s is configured twice", binary.Name)
+		}
+		seen[binary.Name] = true
+
+		var err error
+		binary.constraint, err = natsinfo.ParseConstraint(binary.Version)
+		if err != nil {
+			return nil, fmt.Errorf("nats binary %s: %w", binary.Name, err)
+		}
+		parsed = append(parsed, binary)
+	}
+
+	return parsed, nil
+}
+
+// Find returns the position of the binary called name.
+func (b NATSBinaries) Find(name string) (int, bool) {
+	for i, binary := range b {
+		if binary.Name == name {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// ForVersion returns the position of the first binary whose version
+// constraint version satisfies.
+func (b NATSBinaries) ForVersion(version natsinfo.SemVer) (int, bool) {
+	for i, binary := range b {
+		if binary.Matches(version) {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// Newest returns the position of the last binary.
+func (b NATSBinaries) Newest() int {
+	return len(b) - 1
+}
+
+// Matches reports whether version satisfies the version constraint of the
+// binary. It only works on binaries returned by Config.Binaries.
+func (b NATSBinary) Matches(version natsinfo.SemVer) bool {
+	return b.constraint.Check(version)
+}
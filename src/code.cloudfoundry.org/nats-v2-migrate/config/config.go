@@ -1,31 +1,111 @@
 package config
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"os"
+	"time"
 
 	"code.cloudfoundry.org/lager/v3/lagerflags"
+	"code.cloudfoundry.org/nats-v2-migrate/natsinfo"
+	"code.cloudfoundry.org/tlsconfig"
 )
 
 type Config struct {
-	Address                   string   `json:"address"`
-	Bootstrap                 bool     `json:"bootstrap"`
-	NATSInstances             []string `json:"nats_instances"`
-	NATSPort                  int      `json:"nats_port"`
-	NATSMigratePort           int      `json:"nats_migrate_port"`
-	NATSMigrateServers        []string `json:"nats_migrate_servers"`
-	NATSMigrateServerCAFile   string   `json:"nats_migrate_server_ca_file"`
-	NATSMigrateServerCertFile string   `json:"nats_migrate_server_cert_file"`
-	NATSMigrateServerKeyFile  string   `json:"nats_migrate_server_key_file"`
-	NATSMigrateClientCAFile   string   `json:"nats_migrate_client_ca_file"`
-	NATSMigrateClientCertFile string   `json:"nats_migrate_client_cert_file"`
-	NATSMigrateClientKeyFile  string   `json:"nats_migrate_client_key_file"`
-	NATSV1BinPath             string   `json:"nats_v1_bin_path"`
-	NATSV2BinPath             string   `json:"nats_v2_bin_path"`
-	NATSConfigPath            string   `json:"nats_config_path"`
+	Address                   string       `json:"address"`
+	Bootstrap                 bool         `json:"bootstrap"`
+	NATSInstances             []string     `json:"nats_instances"`
+	NATSPort                  int          `json:"nats_port"`
+	NATSClusterPort           int          `json:"nats_cluster_port"`
+	NATSMigratePort           int          `json:"nats_migrate_port"`
+	NATSMigrateServers        []string     `json:"nats_migrate_servers"`
+	NATSMigrateServerCAFile   string       `json:"nats_migrate_server_ca_file"`
+	NATSMigrateServerCertFile string       `json:"nats_migrate_server_cert_file"`
+	NATSMigrateServerKeyFile  string       `json:"nats_migrate_server_key_file"`
+	NATSMigrateClientCAFile   string       `json:"nats_migrate_client_ca_file"`
+	NATSMigrateClientCertFile string       `json:"nats_migrate_client_cert_file"`
+	NATSMigrateClientKeyFile  string       `json:"nats_migrate_client_key_file"`
+	NATSV1BinPath             string       `json:"nats_v1_bin_path"`
+	NATSV2BinPath             string       `json:"nats_v2_bin_path"`
+	NATSBinaries              NATSBinaries `json:"nats_binaries"`
+	NATSConfigPath            string       `json:"nats_config_path"`
+	NATSTLSCAFile             string       `json:"nats_tls_ca_file"`
+	NATSTLSCertFile           string       `json:"nats_tls_cert_file"`
+	NATSTLSKeyFile            string       `json:"nats_tls_key_file"`
+	NATSTLSServerName         string       `json:"nats_tls_server_name"`
+	NATSTLSFirst              bool         `json:"nats_tls_first"`
+	NATSInternalTLSEnabled    bool         `json:"nats_internal_tls_enabled"`
+	NATSInternalTLSCAFile     string       `json:"nats_internal_tls_ca_file"`
+	NATSInternalTLSCertFile   string       `json:"nats_internal_tls_cert_file"`
+	NATSInternalTLSKeyFile    string       `json:"nats_internal_tls_key_file"`
+	NATSUser                  string       `json:"nats_user"`
+	NATSPassword              string       `json:"nats_password"`
+	NATSProbeTimeout          Duration     `json:"nats_probe_timeout"`
+	NATSProbeRetries          int          `json:"nats_probe_retries"`
+	NATSProbeRetryInterval    Duration     `json:"nats_probe_retry_interval"`
+	NATSProbeMaxRetryInterval Duration     `json:"nats_probe_max_retry_interval"`
+	NATSProbeJitter           float64      `json:"nats_probe_jitter"`
+	NATSProbeDeadline         Duration     `json:"nats_probe_deadline"`
+	NATSProbeWorkers          int          `json:"nats_probe_workers"`
+	NATSMonitorPort           int          `json:"nats_monitor_port"`
+	NATSMonitorHTTPS          bool         `json:"nats_monitor_https"`
+	NATSRequiredVersion       string       `json:"nats_required_version"`
+	NATSLameDuckDuration      Duration     `json:"nats_lame_duck_duration"`
+	NATSLameDuckGracePeriod   Duration     `json:"nats_lame_duck_grace_period"`
+	NATSSupervise             bool         `json:"nats_supervise"`
+	NATSRestartInitialBackoff Duration     `json:"nats_restart_initial_backoff"`
+	NATSRestartMaxBackoff     Duration     `json:"nats_restart_max_backoff"`
+	NATSRestartMaxRestarts    int          `json:"nats_restart_max_restarts"`
+	NATSRestartWindow         Duration     `json:"nats_restart_window"`
+	NATSConfigWatchInterval   Duration     `json:"nats_config_watch_interval"`
+	NATSConfigReloadDebounce  Duration     `json:"nats_config_reload_debounce"`
+	NATSReadinessTimeout      Duration     `json:"nats_readiness_timeout"`
+	NATSStateFile             string       `json:"nats_state_file"`
+	NATSBinaryOverride        string       `json:"nats_binary_override"`
+	NATSBinaryQuorum          string       `json:"nats_binary_quorum"`
+	NATSBinaryMinResponses    int          `json:"nats_binary_min_responses"`
+	NATSBinaryQuorumTimeout   Duration     `json:"nats_binary_quorum_timeout"`
+	NATSBinaryQuorumInterval  Duration     `json:"nats_binary_quorum_interval"`
+	NATSMetricsPort           int          `json:"nats_metrics_port"`
+	NATSEmbedded              bool         `json:"nats_embedded"`
+	NATSMemLimitAlert         string       `json:"nats_mem_limit_alert"`
+	NATSMemLimitRestart       string       `json:"nats_mem_limit_restart"`
+	NATSMemCheckInterval      Duration     `json:"nats_mem_check_interval"`
+	NATSLogPassthrough        bool         `json:"nats_log_passthrough"`
+	NATSPidFile               string       `json:"nats_pid_file"`
+	NATSOrphanPolicy          string       `json:"nats_orphan_policy"`
+
+	// NATSMigrateAuthorizedClients maps migrate server paths, or "*" for all
+	// other paths, to the client certificate identities allowed to call them.
+	NATSMigrateAuthorizedClients map[string][]string `json:"nats_migrate_authorized_clients"`
+
 	lagerflags.LagerConfig
 }
 
+// Duration is a time.Duration that is written as a string such as "6s" in
+// the JSON config.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	err := json.Unmarshal(b, &s)
+	if err != nil {
+		return err
+	}
+
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+
+	return nil
+}
+
 func NewConfig(configPath string) (Config, error) {
 	var cfg Config
 	configBytes, err := os.ReadFile(configPath)
@@ -40,3 +120,82 @@ func NewConfig(configPath string) (Config, error) {
 
 	return cfg, nil
 }
+
+// ProbeOptions builds the options natsinfo uses to talk to the nats servers
+// of this cluster. TLS is only configured when a CA file is set.
+func (c Config) ProbeOptions() (natsinfo.ProbeOptions, error) {
+	opts := natsinfo.ProbeOptions{
+		TLSFirst: c.NATSTLSFirst,
+		User:     c.NATSUser,
+		Password: c.NATSPassword,
+	}
+	if c.NATSTLSCAFile == "" {
+		return opts, nil
+	}
+
+	tlsOptions := []tlsconfig.TLSOption{tlsconfig.WithInternalServiceDefaults()}
+	if c.NATSTLSCertFile != "" {
+		tlsOptions = append(tlsOptions, tlsconfig.WithIdentityFromFile(c.NATSTLSCertFile, c.NATSTLSKeyFile))
+	}
+
+	tlsConfig, err := tlsconfig.Build(tlsOptions...).Client(
+		tlsconfig.WithAuthorityFromFile(c.NATSTLSCAFile),
+		tlsconfig.WithServerName(c.NATSTLSServerName),
+	)
+	if err != nil {
+		return natsinfo.ProbeOptions{}, err
+	}
+	opts.TLSConfig = tlsConfig
+
+	return opts, nil
+}
+
+// RouteTLSConfig builds the TLS config for the route listeners of the peers
+// from the internal TLS files. It is nil when internal TLS is not enabled.
+func (c Config) RouteTLSConfig() (*tls.Config, error) {
+	if !c.NATSInternalTLSEnabled {
+		return nil, nil
+	}
+
+	return tlsconfig.Build(
+		tlsconfig.WithInternalServiceDefaults(),
+		tlsconfig.WithIdentityFromFile(c.NATSInternalTLSCertFile, c.NATSInternalTLSKeyFile),
+	).Client(tlsconfig.WithAuthorityFromFile(c.NATSInternalTLSCAFile))
+}
+
+// Prober builds a natsinfo.Prober from the probe settings. Settings that are
+// not set keep the natsinfo defaults.
+func (c Config) Prober() (*natsinfo.Prober, error) {
+	opts, err := c.ProbeOptions()
+	if err != nil {
+		return nil, err
+	}
+
+	routeTLSConfig, err := c.RouteTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	prober := natsinfo.NewProber()
+	prober.ProbeOptions = opts
+	prober.RouteTLSConfig = routeTLSConfig
+	if c.NATSProbeTimeout > 0 {
+		prober.Timeout = time.Duration(c.NATSProbeTimeout)
+	}
+	if c.NATSProbeRetries > 0 {
+		prober.Retries = c.NATSProbeRetries
+	}
+	if c.NATSProbeRetryInterval > 0 {
+		prober.RetryInterval = time.Duration(c.NATSProbeRetryInterval)
+		prober.MaxRetryInterval = time.Duration(c.NATSProbeRetryInterval)
+	}
+	if c.NATSProbeMaxRetryInterval > 0 {
+		prober.MaxRetryInterval = time.Duration(c.NATSProbeMaxRetryInterval)
+	}
+	prober.Jitter = c.NATSProbeJitter
+	prober.Deadline = time.Duration(c.NATSProbeDeadline)
+	prober.MonitorPort = c.NATSMonitorPort
+	prober.MonitorHTTPS = c.NATSMonitorHTTPS
+
+	return prober, nil
+}
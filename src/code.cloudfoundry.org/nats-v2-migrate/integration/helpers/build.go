@@ -0,0 +1,31 @@
+package helpers
+
+import (
+	"sync"
+
+	"github.com/onsi/gomega/gexec"
+
+	. "github.com/onsi/gomega"
+)
+
+var (
+	buildsLock sync.Mutex
+	builds     = map[string]string{}
+)
+
+// Build compiles pkg once per test process and returns the path of the
+// binary. gexec.Build links a new binary on every call, which adds seconds to
+// every spec that starts a process.
+func Build(pkg string) string {
+	buildsLock.Lock()
+	defer buildsLock.Unlock()
+
+	if bin, ok := builds[pkg]; ok {
+		return bin
+	}
+
+	bin, err := gexec.Build(pkg, "-buildvcs=false")
+	Expect(err).NotTo(HaveOccurred())
+	builds[pkg] = bin
+	return bin
+}
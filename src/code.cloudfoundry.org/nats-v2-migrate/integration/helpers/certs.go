@@ -0,0 +1,60 @@
+package helpers
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+
+	"code.cloudfoundry.org/cf-networking-helpers/certauthority"
+
+	. "github.com/onsi/gomega"
+)
+
+var (
+	serverCertsLock sync.Mutex
+	serverCerts     []string
+)
+
+// ServerCerts copies a CA and a server certificate and key signed by it into
+// dir and returns the paths of the copies. They are generated once per test
+// process, as certauthority creates 4096 bit RSA keys that take seconds each.
+// Every caller gets its own copies, so specs can overwrite them.
+func ServerCerts(dir string) (caFile, certFile, keyFile string) {
+	serverCertsLock.Lock()
+	defer serverCertsLock.Unlock()
+
+	if serverCerts == nil {
+		cacheDir, err := os.MkdirTemp("", "cert-cache-dir")
+		Expect(err).NotTo(HaveOccurred())
+
+		ca, err := certauthority.NewCertAuthority(cacheDir, "nats-v2-migrate-ca")
+		Expect(err).NotTo(HaveOccurred())
+		keyFile, certFile, err := ca.GenerateSelfSignedCertAndKey("server", []string{}, false)
+		Expect(err).NotTo(HaveOccurred())
+		_, caFile := ca.CAAndKey()
+
+		serverCerts = []string{caFile, certFile, keyFile}
+	}
+
+	return copyFile(serverCerts[0], dir), copyFile(serverCerts[1], dir), copyFile(serverCerts[2], dir)
+}
+
+// CleanupServerCerts removes the generated certificates.
+func CleanupServerCerts() {
+	serverCertsLock.Lock()
+	defer serverCertsLock.Unlock()
+
+	if serverCerts != nil {
+		Expect(os.RemoveAll(filepath.Dir(serverCerts[0]))).To(Succeed())
+		serverCerts = nil
+	}
+}
+
+func copyFile(src, dir string) string {
+	content, err := os.ReadFile(src)
+	Expect(err).NotTo(HaveOccurred())
+
+	path := filepath.Join(dir, filepath.Base(src))
+	Expect(os.WriteFile(path, content, 0600)).To(Succeed())
+	return path
+}
@@ -0,0 +1,108 @@
+package helpers
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	. "github.com/onsi/gomega"
+)
+
+// ExitOnSignal is a trap command that stops the mock like nats-server stops
+// on SIGUSR2 once lame duck mode is over.
+const ExitOnSignal = "kill $pid; exit 0"
+
+// MockNATS is a shell script that stands in for a nats binary. On every start
+// it records Version in OutputFile and then runs until it is stopped, unless it
+// crashes or Exec replaces it with a real server.
+type MockNATS struct {
+	Version    string
+	OutputFile string
+	// AppendOutput appends Version to OutputFile instead of overwriting it,
+	// so that the lines count the starts.
+	AppendOutput bool
+	// PidFile records the pid of the mock, which Exec keeps.
+	PidFile string
+	// StderrLines are written to stderr on every start.
+	StderrLines []string
+	// ExitCode makes the mock exit with it on its first Crashes starts, or on
+	// every start when Crashes is 0. Crashes needs AppendOutput.
+	ExitCode int
+	Crashes  int
+	// Traps maps signal names to the commands the mock runs on them. $pid is
+	// the process the mock waits for, ExitOnSignal stops it.
+	Traps map[string]string
+	// Exec replaces the mock with this binary, started with ExecArgs, or with
+	// the arguments of the mock when ExecArgs is nil.
+	Exec     string
+	ExecArgs []string
+	// CheckConfig is the binary the mock replaces itself with when it is
+	// started with -t to check a config. Without it every config is valid.
+	CheckConfig string
+}
+
+// Write writes the mock to path.
+func (m MockNATS) Write(path string) {
+	var script strings.Builder
+	script.WriteString("#!/bin/sh\n")
+
+	script.WriteString("if [ \"$1\" = \"-t\" ]; then\n")
+	if m.CheckConfig != "" {
+		fmt.Fprintf(&script, "    exec %s \"$@\"\n", m.CheckConfig)
+	} else {
+		script.WriteString("    exit 0\n")
+	}
+	script.WriteString("fi\n")
+
+	signals := make([]string, 0, len(m.Traps))
+	for signal := range m.Traps {
+		signals = append(signals, signal)
+	}
+	sort.Strings(signals)
+	for _, signal := range signals {
+		command := m.Traps[signal]
+		if command == "" {
+			command = ":"
+		}
+		fmt.Fprintf(&script, "trap %s %s\n", shellQuote(command), signal)
+	}
+
+	redirect := ">"
+	if m.AppendOutput {
+		redirect = ">>"
+	}
+	fmt.Fprintf(&script, "echo %s %s%s\n", shellQuote(m.Version), redirect, m.OutputFile)
+	if m.PidFile != "" {
+		fmt.Fprintf(&script, "echo $$ >%s\n", m.PidFile)
+	}
+	for _, line := range m.StderrLines {
+		fmt.Fprintf(&script, "echo %s >&2\n", shellQuote(line))
+	}
+
+	if m.ExitCode != 0 {
+		if m.Crashes > 0 {
+			fmt.Fprintf(&script, "if [ $(wc -l <%s) -le %d ]; then\n    exit %d\nfi\n", m.OutputFile, m.Crashes, m.ExitCode)
+		} else {
+			fmt.Fprintf(&script, "exit %d\n", m.ExitCode)
+		}
+	}
+
+	if m.Exec != "" {
+		args := `"$@"`
+		if m.ExecArgs != nil {
+			args = strings.Join(m.ExecArgs, " ")
+		}
+		fmt.Fprintf(&script, "exec %s %s\n", m.Exec, args)
+	} else {
+		// wait returns early when a trapped signal arrives
+		script.WriteString("sleep 60 &\npid=$!\nwhile kill -0 $pid 2>/dev/null; do\n    wait $pid\ndone\n")
+	}
+
+	Expect(os.WriteFile(path, []byte(script.String()), 0777)).To(Succeed())
+	Expect(os.Chmod(path, 0777)).To(Succeed())
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
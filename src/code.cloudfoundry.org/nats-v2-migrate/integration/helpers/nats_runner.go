@@ -2,6 +2,7 @@ package helpers
 
 import (
 	"fmt"
+	"net"
 	"os/exec"
 	"strconv"
 	"time"
@@ -48,31 +49,49 @@ func (runner *NATSRunner) StartV1() {
 }
 
 func (runner *NATSRunner) Start(version ...string) {
-	if runner.natsSession != nil {
-		panic("starting an already started NATS runner!!!")
+	if version != nil && version[0] == "v1" {
+		runner.start("github.com/nats-io/gnatsd")
+	} else {
+		runner.start("github.com/nats-io/nats-server/v2")
 	}
+}
 
-	var cmd *exec.Cmd
+// StartWithArgs starts a v2 server with additional command line flags. It
+// does not wait for the server to accept connections, since flags such as
+// --tlsverify prevent the plain nats client from connecting.
+func (runner *NATSRunner) StartWithArgs(args ...string) {
+	runner.startWithoutWaiting("github.com/nats-io/nats-server/v2", args...)
 
-	if version != nil && version[0] == "v1" {
-		gnatsdBin, err := gexec.Build("github.com/nats-io/gnatsd", "-buildvcs=false")
-		Expect(err).NotTo(HaveOccurred())
-		cmd = exec.Command(gnatsdBin, "-p", strconv.Itoa(runner.port))
-	} else {
-		natsServerBin, err := gexec.Build("github.com/nats-io/nats-server/v2", "-buildvcs=false")
-		Expect(err).NotTo(HaveOccurred())
-		cmd = exec.Command(natsServerBin, "-p", strconv.Itoa(runner.port))
+	Eventually(func() error {
+		conn, err := net.Dial("tcp", runner.Addr())
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}, 5, 0.1).ShouldNot(HaveOccurred())
+}
+
+func (runner *NATSRunner) start(pkg string) {
+	runner.startWithoutWaiting(pkg)
+
+	Eventually(func() error {
+		_, err := nats.Connect(fmt.Sprintf("nats://127.0.0.1:%d", runner.port))
+		return err
+	}, 5, 0.1).ShouldNot(HaveOccurred())
+}
+
+func (runner *NATSRunner) startWithoutWaiting(pkg string, args ...string) {
+	if runner.natsSession != nil {
+		panic("starting an already started NATS runner!!!")
 	}
 
+	bin := Build(pkg)
+	cmd := exec.Command(bin, append([]string{"-p", strconv.Itoa(runner.port)}, args...)...)
+
 	sess, err := gexec.Start(cmd,
 		gexec.NewPrefixedWriter("\x1b[32m[o]\x1b[34m[nats-server]\x1b[0m ", GinkgoWriter),
 		gexec.NewPrefixedWriter("\x1b[91m[e]\x1b[34m[nats-server]\x1b[0m ", GinkgoWriter))
 	Expect(err).NotTo(HaveOccurred())
 
 	runner.natsSession = sess
-
-	Eventually(func() error {
-		_, err = nats.Connect(fmt.Sprintf("nats://127.0.0.1:%d", runner.port))
-		return err
-	}, 5, 0.1).ShouldNot(HaveOccurred())
 }
@@ -5,9 +5,17 @@ import (
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gexec"
+
+	"code.cloudfoundry.org/nats-v2-migrate/integration/helpers"
 )
 
 func TestIntegration(t *testing.T) {
 	RegisterFailHandler(Fail)
 	RunSpecs(t, "Integration Suite")
 }
+
+var _ = AfterSuite(func() {
+	gexec.CleanupBuildArtifacts()
+	helpers.CleanupServerCerts()
+})
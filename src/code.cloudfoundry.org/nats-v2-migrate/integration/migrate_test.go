@@ -8,7 +8,6 @@ import (
 	"os/exec"
 	"time"
 
-	"code.cloudfoundry.org/cf-networking-helpers/certauthority"
 	"code.cloudfoundry.org/cf-networking-helpers/portauthority"
 	"code.cloudfoundry.org/lager/v3/lagerflags"
 	"code.cloudfoundry.org/nats-v2-migrate/config"
@@ -18,6 +17,7 @@ import (
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
 	"github.com/onsi/gomega/gexec"
 	"github.com/onsi/gomega/ghttp"
 )
@@ -27,16 +27,16 @@ var _ = Describe("Migrate", func() {
 		cfg         config.Config
 		configFile  *os.File
 		migrateBin  string
+		migrateArgs []string
 		migrateSess *gexec.Session
 	)
 
 	BeforeEach(func() {
-		var err error
-		migrateBin, err = gexec.Build("code.cloudfoundry.org/nats-v2-migrate/cmd/migrate", "-buildvcs=false")
-		Expect(err).NotTo(HaveOccurred())
+		migrateBin = helpers.Build("code.cloudfoundry.org/nats-v2-migrate/cmd/migrate")
 		cfg = config.Config{
 			LagerConfig: lagerflags.DefaultLagerConfig(),
 		}
+		migrateArgs = nil
 
 		node := GinkgoParallelProcess()
 		startPort := 1000 * node
@@ -63,7 +63,7 @@ var _ = Describe("Migrate", func() {
 		_, err = configFile.Write(cfgJSON)
 		Expect(err).NotTo(HaveOccurred())
 
-		migrateCmd := exec.Command(migrateBin, "-config-file", configFile.Name())
+		migrateCmd := exec.Command(migrateBin, append([]string{"-config-file", configFile.Name()}, migrateArgs...)...)
 		migrateSess, err = gexec.Start(migrateCmd, GinkgoWriter, GinkgoWriter)
 		Expect(err).NotTo(HaveOccurred())
 	})
@@ -107,12 +107,7 @@ var _ = Describe("Migrate", func() {
 			certDepoDir, err = os.MkdirTemp("", "cert-depot-dir-")
 			Expect(err).NotTo(HaveOccurred())
 
-			ca, err := certauthority.NewCertAuthority(certDepoDir, "nats-v2-migrate-ca")
-			Expect(err).NotTo(HaveOccurred())
-
-			serverKeyFile, serverCertFile, err := ca.GenerateSelfSignedCertAndKey("server", []string{}, false)
-			Expect(err).NotTo(HaveOccurred())
-			_, serverCAFile := ca.CAAndKey()
+			serverCAFile, serverCertFile, serverKeyFile := helpers.ServerCerts(certDepoDir)
 			cfg.NATSMigrateServerCAFile = serverCAFile
 			cfg.NATSMigrateServerCertFile = serverCertFile
 			cfg.NATSMigrateServerKeyFile = serverKeyFile
@@ -145,6 +140,62 @@ var _ = Describe("Migrate", func() {
 			natsMigrateServer3.Close()
 		})
 
+		Context("when asked for the status", func() {
+			BeforeEach(func() {
+				migrateArgs = []string{"-status"}
+			})
+
+			It("logs the status of every node without migrating", func() {
+				Eventually(migrateSess).Should(gexec.Exit(0))
+				Expect(migrateSess.Out).To(gbytes.Say(`"status":{"binary":"v2".*"migration":"migrated"`))
+
+				for _, server := range []*ghttp.Server{natsMigrateServer1, natsMigrateServer2, natsMigrateServer3} {
+					Expect(server.ReceivedRequests()).To(HaveLen(1))
+					Expect(server.ReceivedRequests()[0].URL.Path).To(Equal("/status"))
+				}
+			})
+
+			Context("when a node does not answer", func() {
+				BeforeEach(func() {
+					natsMigrateServer3.Close()
+				})
+
+				It("exits with an error", func() {
+					Eventually(migrateSess).Should(gexec.Exit(1))
+					Expect(migrateSess.Out).To(gbytes.Say("Failed to get status"))
+				})
+			})
+		})
+
+		Context("when asked to roll back", func() {
+			BeforeEach(func() {
+				migrateArgs = []string{"-rollback"}
+			})
+
+			It("rolls back every node", func() {
+				Eventually(migrateSess).Should(gexec.Exit(0))
+				Expect(migrateSess.Out).To(gbytes.Say("Finished rollback"))
+
+				for _, server := range []*ghttp.Server{natsMigrateServer1, natsMigrateServer2, natsMigrateServer3} {
+					Expect(server.ReceivedRequests()).To(HaveLen(1))
+					Expect(server.ReceivedRequests()[0].URL.Path).To(Equal("/rollback"))
+				}
+			})
+
+			Context("when a node fails to roll back", func() {
+				BeforeEach(func() {
+					natsMigrateServer2.RouteToHandler("POST", "/rollback", ghttp.RespondWith(http.StatusInternalServerError, ""))
+				})
+
+				It("still rolls back the other nodes and exits with an error", func() {
+					Eventually(migrateSess).Should(gexec.Exit(1))
+					Expect(natsMigrateServer1.ReceivedRequests()).To(HaveLen(1))
+					Expect(natsMigrateServer3.ReceivedRequests()).To(HaveLen(1))
+					Expect(migrateSess.Out).To(gbytes.Say("Some nats instances failed to roll back"))
+				})
+			})
+		})
+
 		Context("when the local NATS server is running the v2 version", func() {
 			BeforeEach(func() {
 				natsRunner.Start()
@@ -158,6 +209,68 @@ var _ = Describe("Migrate", func() {
 			})
 		})
 
+		Context("when migrating to a named target", func() {
+			BeforeEach(func() {
+				cfg.NATSBinaries = config.NATSBinaries{
+					{Name: "gnatsd", BinPath: "/bin/gnatsd", Version: "<2"},
+					{Name: "2.10", BinPath: "/bin/nats-server-2.10", Version: ">=2.10.0 <2.11.0"},
+					{Name: "2.11", BinPath: "/bin/nats-server-2.11", Version: ">=2.11.0"},
+				}
+				natsRunner.Start()
+			})
+
+			Context("when the local NATS server does not run the target yet", func() {
+				BeforeEach(func() {
+					migrateArgs = []string{"-target", "2.11"}
+				})
+
+				It("asks every migrate server to migrate to the target", func() {
+					Eventually(migrateSess).Should(gexec.Exit(0))
+					for _, server := range []*ghttp.Server{natsMigrateServer1, natsMigrateServer2, natsMigrateServer3} {
+						Expect(server.ReceivedRequests()).To(HaveLen(2))
+						Expect(server.ReceivedRequests()[1].URL.Path).To(Equal("/migrate"))
+					}
+				})
+
+				Context("when a migrate server checks the target", func() {
+					BeforeEach(func() {
+						natsMigrateServer2.RouteToHandler("POST", "/migrate", ghttp.CombineHandlers(
+							ghttp.VerifyRequest("POST", "/migrate"),
+							ghttp.VerifyJSON(`{"target":"2.11"}`),
+							ghttp.RespondWith(http.StatusOK, ""),
+						))
+					})
+
+					It("sends the target in the request", func() {
+						Eventually(migrateSess).Should(gexec.Exit(0))
+					})
+				})
+			})
+
+			Context("when the local NATS server already runs the target", func() {
+				BeforeEach(func() {
+					migrateArgs = []string{"-target", "2.10"}
+				})
+
+				It("skips the migration", func() {
+					Eventually(migrateSess).Should(gexec.Exit(0))
+					Expect(migrateSess.Out).To(gbytes.Say("Local NATS instance already runs 2.10"))
+					Expect(natsMigrateServer2.ReceivedRequests()).To(BeEmpty())
+				})
+			})
+
+			Context("when the target is unknown", func() {
+				BeforeEach(func() {
+					migrateArgs = []string{"-target", "3.0"}
+				})
+
+				It("exits with an error", func() {
+					Eventually(migrateSess).Should(gexec.Exit(1))
+					Expect(migrateSess.Out).To(gbytes.Say("there is no nats binary called 3.0"))
+				})
+			})
+		})
+
 		Context("when it fails to connect to local NATS server", func() {
 			It("fails with error after the timeout", func() {
 				Eventually(migrateSess).WithTimeout(61 * time.Second).Should(gexec.Exit(1))
@@ -211,6 +324,20 @@ var _ = Describe("Migrate", func() {
 
 				Context("when there is a migrate server on bootstrap VM", func() {
 					Context("when migration to v2 succeeds on bootstrap VM", func() {
+						Context("when the bootstrap migrate server checks the target", func() {
+							BeforeEach(func() {
+								natsMigrateServer2.RouteToHandler("POST", "/migrate", ghttp.CombineHandlers(
+									ghttp.VerifyRequest("POST", "/migrate"),
+									ghttp.VerifyJSON(`{"target":"v2"}`),
+									ghttp.RespondWith(http.StatusOK, ""),
+								))
+							})
+
+							It("asks it to migrate to v2", func() {
+								Eventually(migrateSess).Should(gexec.Exit(0))
+							})
+						})
+
 						It("tells other migrate servers to migrate to v2", func() {
 							Eventually(natsMigrateServer1.ReceivedRequests).Should(HaveLen(2))
 							Expect(natsMigrateServer1.ReceivedRequests()[0].URL.Path).To(Equal("/info"))
@@ -350,5 +477,15 @@ func NewNATSMigrateServer(serverCAFile, serverCertFile, serverKeyFile string, is
 		ghttp.VerifyRequest("POST", "/migrate"),
 		ghttp.RespondWith(http.StatusOK, ""),
 	))
+
+	natsMigrateServer.RouteToHandler("POST", "/rollback", ghttp.CombineHandlers(
+		ghttp.VerifyRequest("POST", "/rollback"),
+		ghttp.RespondWith(http.StatusOK, ""),
+	))
+
+	natsMigrateServer.RouteToHandler("GET", "/status", ghttp.CombineHandlers(
+		ghttp.VerifyRequest("GET", "/status"),
+		ghttp.RespondWith(http.StatusOK, `{"binary":"v2","version":"2.10.22","running":true,"migration":"migrated"}`),
+	))
 	return natsMigrateServer
 }
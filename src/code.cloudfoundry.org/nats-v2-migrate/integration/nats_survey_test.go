@@ -0,0 +1,107 @@
+package integration
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+
+	"code.cloudfoundry.org/cf-networking-helpers/portauthority"
+	"code.cloudfoundry.org/nats-v2-migrate/config"
+	"code.cloudfoundry.org/nats-v2-migrate/integration/helpers"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+	"github.com/onsi/gomega/gexec"
+)
+
+var _ = Describe("nats-survey", func() {
+	var (
+		cfg                config.Config
+		configFile         *os.File
+		surveyBin          string
+		v1Runner, v2Runner *helpers.NATSRunner
+		surveySess         *gexec.Session
+		format             string
+	)
+
+	BeforeEach(func() {
+		surveyBin = helpers.Build("code.cloudfoundry.org/nats-v2-migrate/cmd/nats-survey")
+
+		node := GinkgoParallelProcess()
+		allocator, err := portauthority.New(1000*node, 1000*node+950)
+		Expect(err).NotTo(HaveOccurred())
+		port, err := allocator.ClaimPorts(2)
+		Expect(err).NotTo(HaveOccurred())
+
+		v1Runner = helpers.NewNATSRunner(int(port))
+		v2Runner = helpers.NewNATSRunner(int(port + 1))
+		v1Runner.StartV1()
+		v2Runner.Start()
+
+		cfg = config.Config{
+			NATSInstances: []string{v1Runner.Addr(), v2Runner.Addr()},
+		}
+	})
+
+	JustBeforeEach(func() {
+		var err error
+		configFile, err = os.CreateTemp("", "survey-config-")
+		Expect(err).NotTo(HaveOccurred())
+
+		cfgJSON, err := json.Marshal(cfg)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = configFile.Write(cfgJSON)
+		Expect(err).NotTo(HaveOccurred())
+
+		surveyCmd := exec.Command(surveyBin, "-config-file", configFile.Name(), "-format", format)
+		surveySess, err = gexec.Start(surveyCmd, GinkgoWriter, GinkgoWriter)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		surveySess.Kill()
+		v1Runner.Stop()
+		v2Runner.Stop()
+		os.Remove(configFile.Name())
+	})
+
+	Context("with the table format", func() {
+		BeforeEach(func() {
+			format = "table"
+		})
+
+		It("prints a row per instance and flags the mixed versions", func() {
+			Eventually(surveySess).Should(gexec.Exit(0))
+			Expect(surveySess.Out).To(gbytes.Say(`INSTANCE\s+VERSION`))
+			Expect(surveySess.Out).To(gbytes.Say(v1Runner.Addr() + `\s+1\.4\.1`))
+			Expect(surveySess.Out).To(gbytes.Say(v2Runner.Addr() + `\s+2\.`))
+			Expect(surveySess.Out).To(gbytes.Say("The cluster is running mixed versions: 1.4.1, 2."))
+		})
+	})
+
+	Context("with the json format", func() {
+		BeforeEach(func() {
+			format = "json"
+		})
+
+		It("prints the survey as json", func() {
+			Eventually(surveySess).Should(gexec.Exit(0))
+
+			var report struct {
+				Mixed     bool `json:"mixed"`
+				Instances []struct {
+					Instance  string `json:"instance"`
+					Reachable bool   `json:"reachable"`
+					Version   string `json:"version"`
+				} `json:"instances"`
+			}
+			Expect(json.Unmarshal(surveySess.Out.Contents(), &report)).To(Succeed())
+			Expect(report.Mixed).To(BeTrue())
+			Expect(report.Instances).To(HaveLen(2))
+			Expect(report.Instances[0].Instance).To(Equal(v1Runner.Addr()))
+			Expect(report.Instances[0].Version).To(Equal("1.4.1"))
+			Expect(report.Instances[1].Reachable).To(BeTrue())
+		})
+	})
+})
@@ -12,10 +12,16 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
+	"github.com/nats-io/nats.go"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
 	"github.com/onsi/gomega/gexec"
 
 	"code.cloudfoundry.org/cf-networking-helpers/certauthority"
@@ -41,16 +47,7 @@ func GenerateCerts(cfg *config.Config) {
 	certDepoDir, err = os.MkdirTemp("", "cert-depot-dir")
 	Expect(err).NotTo(HaveOccurred())
 
-	ca, err := certauthority.NewCertAuthority(certDepoDir, "nats-v2-migrate-ca")
-	Expect(err).NotTo(HaveOccurred())
-
-	serverKeyFile, serverCertFile, err := ca.GenerateSelfSignedCertAndKey("server", []string{}, false)
-	Expect(err).NotTo(HaveOccurred())
-
-	_, serverCAFile := ca.CAAndKey()
-	cfg.NATSMigrateServerCAFile = serverCAFile
-	cfg.NATSMigrateServerCertFile = serverCertFile
-	cfg.NATSMigrateServerKeyFile = serverKeyFile
+	cfg.NATSMigrateServerCAFile, cfg.NATSMigrateServerCertFile, cfg.NATSMigrateServerKeyFile = helpers.ServerCerts(certDepoDir)
 }
 
 func StartServer(cfg config.Config) {
@@ -66,7 +63,7 @@ func StartServer(cfg config.Config) {
 	Eventually(serverIsAvailable, "60s").Should(Succeed())
 }
 
-func StartServerWithoutWaiting(cfg config.Config) {
+func StartServerWithoutWaiting(cfg config.Config, args ...string) {
 	var err error
 	cfgFile, err = os.CreateTemp("", "migrate-config.json")
 	Expect(err).NotTo(HaveOccurred())
@@ -76,10 +73,9 @@ func StartServerWithoutWaiting(cfg config.Config) {
 	_, err = cfgFile.Write(cfgJSON)
 	Expect(err).NotTo(HaveOccurred())
 
-	serverBin, err := gexec.Build("code.cloudfoundry.org/nats-v2-migrate/nats-wrapper", "-buildvcs=false")
-	Expect(err).NotTo(HaveOccurred())
+	serverBin := helpers.Build("code.cloudfoundry.org/nats-v2-migrate/nats-wrapper")
 
-	startCmd := exec.Command(serverBin, "-config-file", cfgFile.Name())
+	startCmd := exec.Command(serverBin, append([]string{"-config-file", cfgFile.Name()}, args...)...)
 	session, err = gexec.Start(startCmd, GinkgoWriter, GinkgoWriter)
 	Expect(err).NotTo(HaveOccurred())
 }
@@ -107,23 +103,6 @@ func CreateTLSClient(cfg config.Config) http.Client {
 	return http.Client{Transport: t, Timeout: 15 * time.Second}
 }
 
-func CreateMockNATS(natsPath string, version string, outputFile string) {
-	mockNATSScript := `#!/bin/sh 
-    echo "` + version + `" >` + outputFile + `
-	sleep 60`
-
-	natsFile, err := os.Create(natsPath)
-	Expect(err).NotTo(HaveOccurred())
-
-	err = os.Chmod(natsPath, 0777)
-	Expect(err).NotTo(HaveOccurred())
-
-	_, err = io.WriteString(natsFile, mockNATSScript)
-	Expect(err).NotTo(HaveOccurred())
-
-	natsFile.Close()
-}
-
 var _ = Describe("NATS Wrapper", func() {
 	BeforeEach(func() {
 		node := GinkgoParallelProcess()
@@ -146,14 +125,17 @@ var _ = Describe("NATS Wrapper", func() {
 
 		file, err = os.CreateTemp("", "nats-v1-sh-")
 		Expect(err).NotTo(HaveOccurred())
+		// the mock is executed, which fails while a writable fd is open
+		Expect(file.Close()).To(Succeed())
 		natsV1File = file.Name()
 
 		file, err = os.CreateTemp("", "nats-v2-sh-")
 		Expect(err).NotTo(HaveOccurred())
+		Expect(file.Close()).To(Succeed())
 		natsV2File = file.Name()
 
-		CreateMockNATS(natsV1File, "v1", outputFile)
-		CreateMockNATS(natsV2File, "v2", outputFile)
+		helpers.MockNATS{Version: "v1", OutputFile: outputFile}.Write(natsV1File)
+		helpers.MockNATS{Version: "v2", OutputFile: outputFile}.Write(natsV2File)
 	})
 
 	AfterEach(func() {
@@ -242,9 +224,12 @@ var _ = Describe("NATS Wrapper", func() {
 				})
 
 				It("starts as v2", func() {
+					Eventually(func() string {
+						content, _ := os.ReadFile(outputFile)
+						return string(content)
+					}).Should(ContainSubstring("v2"))
 					content, err := os.ReadFile(outputFile)
 					Expect(err).ToNot(HaveOccurred())
-					Expect(string(content)).To(ContainSubstring("v2"))
 					Expect(string(content)).NotTo(ContainSubstring("v1"))
 				})
 			})
@@ -327,6 +312,180 @@ var _ = Describe("NATS Wrapper", func() {
 		})
 	})
 
+	Describe("peer route check", func() {
+		var (
+			natsRunner1 *helpers.NATSRunner
+			certDir     string
+		)
+
+		BeforeEach(func() {
+			node := GinkgoParallelProcess()
+			allocator, err := portauthority.New(1000*node+950, 1000*node+999)
+			Expect(err).NotTo(HaveOccurred())
+			clusterPort, err := allocator.ClaimPorts(1)
+			Expect(err).NotTo(HaveOccurred())
+
+			certDir, err = os.MkdirTemp("", "internal-tls-")
+			Expect(err).NotTo(HaveOccurred())
+			caFile, certFile, keyFile := helpers.ServerCerts(certDir)
+
+			natsConfigFile := filepath.Join(certDir, "nats.conf")
+			natsConfig := fmt.Sprintf(`cluster {
+  name: test-cluster
+  listen: "127.0.0.1:%d"
+  tls {
+    ca_file: %q
+    cert_file: %q
+    key_file: %q
+    verify: true
+  }
+}
+`, clusterPort, caFile, certFile, keyFile)
+			Expect(os.WriteFile(natsConfigFile, []byte(natsConfig), 0644)).To(Succeed())
+
+			natsRunner1 = helpers.NewNATSRunner(int(natsRunnerPort1))
+			natsRunner1.StartWithArgs("-c", natsConfigFile)
+
+			cfg = config.Config{
+				Address:                 "127.0.0.1",
+				Bootstrap:               true,
+				NATSMigratePort:         int(natsMigratorPort),
+				NATSPort:                int(natsPort),
+				NATSClusterPort:         int(clusterPort),
+				NATSInstances:           []string{fmt.Sprintf("127.0.0.1:%d", natsPort), natsRunner1.Addr()},
+				NATSV1BinPath:           natsV1File,
+				NATSV2BinPath:           natsV2File,
+				NATSInternalTLSEnabled:  true,
+				NATSInternalTLSCAFile:   caFile,
+				NATSInternalTLSCertFile: certFile,
+				NATSInternalTLSKeyFile:  keyFile,
+			}
+			GenerateCerts(&cfg)
+		})
+
+		AfterEach(func() {
+			natsRunner1.Stop()
+			os.RemoveAll(certDir)
+		})
+
+		It("reads the route INFO of a peer whose route listener requires TLS", func() {
+			StartServer(cfg)
+
+			Eventually(session.Out).Should(gbytes.Say(`found-peer-route-listener.*"cluster":"test-cluster".*"tls_required":true`))
+			Expect(string(session.Out.Contents())).NotTo(ContainSubstring("peer-route-listener-unreachable"))
+		})
+	})
+
+	Describe("binary quorum", func() {
+		var natsRunner1, natsRunner2, natsRunner3 *helpers.NATSRunner
+
+		readOutput := func() string {
+			content, _ := os.ReadFile(outputFile)
+			return string(content)
+		}
+
+		BeforeEach(func() {
+			node := GinkgoParallelProcess()
+			allocator, err := portauthority.New(1000*node+950, 1000*node+999)
+			Expect(err).NotTo(HaveOccurred())
+			natsRunnerPort3, err := allocator.ClaimPorts(1)
+			Expect(err).NotTo(HaveOccurred())
+
+			natsRunner1 = helpers.NewNATSRunner(int(natsRunnerPort1))
+			natsRunner2 = helpers.NewNATSRunner(int(natsRunnerPort2))
+			natsRunner3 = helpers.NewNATSRunner(int(natsRunnerPort3))
+			natsRunner1.StartV1()
+			natsRunner2.Start()
+
+			cfg = config.Config{
+				Address:         "127.0.0.1",
+				Bootstrap:       true,
+				NATSMigratePort: int(natsMigratorPort),
+				NATSPort:        int(natsPort),
+				NATSInstances: []string{
+					fmt.Sprintf("127.0.0.1:%d", natsPort),
+					natsRunner1.Addr(),
+					natsRunner2.Addr(),
+					natsRunner3.Addr(),
+				},
+				NATSV1BinPath:          natsV1File,
+				NATSV2BinPath:          natsV2File,
+				NATSProbeRetries:       1,
+				NATSProbeTimeout:       config.Duration(500 * time.Millisecond),
+				NATSProbeRetryInterval: config.Duration(100 * time.Millisecond),
+			}
+			GenerateCerts(&cfg)
+		})
+
+		AfterEach(func() {
+			natsRunner1.Stop()
+			natsRunner2.Stop()
+			natsRunner3.Stop()
+		})
+
+		Context("when all peers answer", func() {
+			BeforeEach(func() {
+				natsRunner3.Start()
+			})
+
+			It("starts as the oldest binary and logs every answer in one line", func() {
+				StartServer(cfg)
+
+				Eventually(session.Out).Should(gbytes.Say(`"message":"nats-migrate-server.selected-binary-from-peers","data":{"binary":"v1","min_responses":0,"peers":{"` +
+					natsRunner1.Addr() + `":"v1","` + natsRunner2.Addr() + `":"v2","` + natsRunner3.Addr() + `":"v2"},"policy":"all-reachable","responses":3}`))
+				Eventually(readOutput).Should(Equal("v1\n"))
+			})
+
+			It("starts as the binary of the majority with the majority policy", func() {
+				cfg.NATSBinaryQuorum = "majority"
+				StartServer(cfg)
+
+				Eventually(session.Out).Should(gbytes.Say(`selected-binary-from-peers","data":{"binary":"v2",.*"policy":"majority","responses":3}`))
+				Eventually(readOutput).Should(Equal("v2\n"))
+			})
+		})
+
+		Context("when fewer peers answer than required", func() {
+			BeforeEach(func() {
+				cfg.NATSBinaryMinResponses = 3
+			})
+
+			It("exits with an error", func() {
+				StartServerWithoutWaiting(cfg)
+
+				Eventually(session, 10).Should(gexec.Exit(2))
+				Expect(session.Out).To(gbytes.Say(`too-few-peers-answered.*"error":"2 of 3 peers answered, 3 are required".*"` + natsRunner3.Addr() + `":"unreachable"`))
+				Expect(readOutput()).To(BeEmpty())
+			})
+
+			It("asks the peers again until enough answer within the timeout", func() {
+				cfg.NATSBinaryQuorumTimeout = config.Duration(30 * time.Second)
+				cfg.NATSBinaryQuorumInterval = config.Duration(100 * time.Millisecond)
+				StartServerWithoutWaiting(cfg)
+
+				Eventually(session.Out, 10).Should(gbytes.Say("waiting-for-more-peers-to-answer"))
+				Expect(readOutput()).To(BeEmpty())
+
+				natsRunner3.Start()
+				Eventually(session.Out, 10).Should(gbytes.Say(`selected-binary-from-peers.*"responses":3`))
+				Eventually(readOutput).Should(Equal("v1\n"))
+			})
+		})
+
+		Context("with an invalid policy", func() {
+			BeforeEach(func() {
+				cfg.NATSBinaryQuorum = "first-v1-wins"
+			})
+
+			It("exits with an error", func() {
+				StartServerWithoutWaiting(cfg)
+
+				Eventually(session, 10).Should(gexec.Exit(2))
+				Expect(session.Out).To(gbytes.Say(`invalid nats_binary_quorum`))
+			})
+		})
+	})
+
 	Describe("/info", func() {
 		Context("when the server is the bootstrap instance", func() {
 			BeforeEach(func() {
@@ -379,6 +538,79 @@ var _ = Describe("NATS Wrapper", func() {
 		})
 	})
 
+	Describe("/status and /health", func() {
+		var localNATS *helpers.NATSRunner
+
+		BeforeEach(func() {
+			localNATS = helpers.NewNATSRunner(int(natsPort))
+
+			cfg = config.Config{
+				NATSInstances:   []string{fmt.Sprintf("127.0.0.1:%d", natsPort)},
+				Bootstrap:       true,
+				Address:         "127.0.0.1",
+				NATSPort:        int(natsPort),
+				NATSMigratePort: int(natsMigratorPort),
+				NATSV1BinPath:   natsV1File,
+				NATSV2BinPath:   natsV2File,
+			}
+			GenerateCerts(&cfg)
+			StartServer(cfg)
+			client = CreateTLSClient(cfg)
+		})
+
+		AfterEach(func() {
+			localNATS.Stop()
+		})
+
+		getJSON := func(path string, response interface{}) int {
+			resp, err := client.Get(fmt.Sprintf("https://%s%s", address, path))
+			Expect(err).NotTo(HaveOccurred())
+			defer resp.Body.Close()
+			Expect(json.NewDecoder(resp.Body).Decode(response)).To(Succeed())
+			return resp.StatusCode
+		}
+
+		It("reports the running binary and its state", func() {
+			var status map[string]interface{}
+			Expect(getJSON("/status", &status)).To(Equal(http.StatusOK))
+
+			Expect(status["binary"]).To(Equal("v2"))
+			Expect(status["bin_path"]).To(Equal(natsV2File))
+			Expect(status["running"]).To(BeTrue())
+			Expect(status["pid"]).To(BeNumerically(">", 0))
+			Expect(status["started_at"]).NotTo(BeEmpty())
+			Expect(status["uptime"]).NotTo(BeEmpty())
+			Expect(status["restarts"]).To(BeNumerically("==", 0))
+			Expect(status["migration"]).To(Equal("not-needed"))
+			Expect(status).To(HaveKeyWithValue("last_exit_code", BeNil()))
+			Expect(status).NotTo(HaveKey("version"))
+		})
+
+		It("is unhealthy while nats does not accept connections", func() {
+			var health map[string]interface{}
+			Expect(getJSON("/health", &health)).To(Equal(http.StatusServiceUnavailable))
+			Expect(health["healthy"]).To(BeFalse())
+			Expect(health["error"]).To(ContainSubstring("connection refused"))
+		})
+
+		Context("when nats accepts connections", func() {
+			BeforeEach(func() {
+				localNATS.Start()
+			})
+
+			It("is healthy and reports the version", func() {
+				var health map[string]interface{}
+				Expect(getJSON("/health", &health)).To(Equal(http.StatusOK))
+				Expect(health["healthy"]).To(BeTrue())
+				Expect(health["version"]).To(HavePrefix("2."))
+
+				var status map[string]interface{}
+				Expect(getJSON("/status", &status)).To(Equal(http.StatusOK))
+				Expect(status["version"]).To(HavePrefix("2."))
+			})
+		})
+	})
+
 	Describe("/migrate", func() {
 		var natsRunner1 *helpers.NATSRunner
 
@@ -436,15 +668,1767 @@ var _ = Describe("NATS Wrapper", func() {
 				Expect(string(content)).NotTo(ContainSubstring("v1"))
 			})
 		})
+		Context("when the migration has finished", func() {
+			It("reports the migration on /status", func() {
+				resp, err := client.Post(fmt.Sprintf("https://%s/migrate", address), "application/json", nil)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(resp.StatusCode).To(Equal(200))
+
+				resp, err = client.Get(fmt.Sprintf("https://%s/status", address))
+				Expect(err).ToNot(HaveOccurred())
+				defer resp.Body.Close()
+
+				var status map[string]interface{}
+				Expect(json.NewDecoder(resp.Body).Decode(&status)).To(Succeed())
+				Expect(status["binary"]).To(Equal("v2"))
+				Expect(status["migration"]).To(Equal("migrated"))
+				Expect(status["running"]).To(BeTrue())
+				Expect(status).To(HaveKeyWithValue("last_exit_code", Not(BeNil())))
+			})
+		})
+		Context("when the node is rolled back", func() {
+			It("stops v2 and starts v1 again", func() {
+				resp, err := client.Post(fmt.Sprintf("https://%s/migrate", address), "application/json", nil)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(resp.StatusCode).To(Equal(200))
+				Eventually(func() string {
+					content, _ := os.ReadFile(outputFile)
+					return string(content)
+				}).Should(ContainSubstring("v2"))
+
+				resp, err = client.Post(fmt.Sprintf("https://%s/rollback", address), "application/json", nil)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(resp.StatusCode).To(Equal(200))
+				Eventually(func() string {
+					content, _ := os.ReadFile(outputFile)
+					return string(content)
+				}).Should(ContainSubstring("v1"))
+
+				resp, err = client.Get(fmt.Sprintf("https://%s/status", address))
+				Expect(err).ToNot(HaveOccurred())
+				defer resp.Body.Close()
+				var status map[string]interface{}
+				Expect(json.NewDecoder(resp.Body).Decode(&status)).To(Succeed())
+				Expect(status["binary"]).To(Equal("v1"))
+				Expect(status["migration"]).To(Equal("rolled-back"))
+			})
+
+			It("can be migrated again", func() {
+				resp, err := client.Post(fmt.Sprintf("https://%s/migrate", address), "application/json", nil)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(resp.StatusCode).To(Equal(200))
+
+				resp, err = client.Post(fmt.Sprintf("https://%s/rollback", address), "application/json", nil)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(resp.StatusCode).To(Equal(200))
+
+				resp, err = client.Post(fmt.Sprintf("https://%s/migrate", address), "application/json", nil)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(resp.StatusCode).To(Equal(200))
+				Eventually(func() string {
+					content, _ := os.ReadFile(outputFile)
+					return string(content)
+				}).Should(ContainSubstring("v2"))
+			})
+
+			It("does nothing when the node still runs v1", func() {
+				resp, err := client.Post(fmt.Sprintf("https://%s/rollback", address), "application/json", nil)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(resp.StatusCode).To(Equal(200))
+				Eventually(session.Out).Should(gbytes.Say(`skipping-rollback-already-on-oldest-binary.*"binary":"v1"`))
+			})
+		})
 		Context("when the server has already been migrated", func() {
-			It("should succeed the first time and get a 409 the second time", func() {
+			It("returns the finished migration without migrating again", func() {
 				resp, err := client.Post(fmt.Sprintf("https://%s/migrate", address), "application/json", nil)
 				Expect(err).ToNot(HaveOccurred())
 				Expect(resp.StatusCode).To(Equal(200))
 
 				resp, err = client.Post(fmt.Sprintf("https://%s/migrate", address), "application/json", nil)
 				Expect(err).ToNot(HaveOccurred())
-				Expect(resp.StatusCode).To(Equal(409))
+				defer resp.Body.Close()
+				Expect(resp.StatusCode).To(Equal(200))
+
+				var status map[string]interface{}
+				Expect(json.NewDecoder(resp.Body).Decode(&status)).To(Succeed())
+				Expect(status["state"]).To(Equal("succeeded"))
+				Expect(status["target"]).To(Equal("v2"))
+				Eventually(session.Out).Should(gbytes.Say(`skipping-migrate-api-call.*"state":"succeeded"`))
+				Expect(session.Out).NotTo(gbytes.Say("received-migration-signal"))
+			})
+		})
+	})
+
+	Describe("client authorization", func() {
+		var otherClient http.Client
+
+		BeforeEach(func() {
+			cfg = config.Config{
+				NATSInstances:   []string{fmt.Sprintf("127.0.0.1:%d", natsPort)},
+				Bootstrap:       true,
+				Address:         "127.0.0.1",
+				NATSPort:        int(natsPort),
+				NATSMigratePort: int(natsMigratorPort),
+				NATSV1BinPath:   natsV1File,
+				NATSV2BinPath:   natsV2File,
+			}
+
+			var err error
+			certDepoDir, err = os.MkdirTemp("", "cert-depot-dir")
+			Expect(err).NotTo(HaveOccurred())
+			ca, err := certauthority.NewCertAuthority(certDepoDir, "nats-v2-migrate-ca")
+			Expect(err).NotTo(HaveOccurred())
+			_, cfg.NATSMigrateServerCAFile = ca.CAAndKey()
+			cfg.NATSMigrateServerKeyFile, cfg.NATSMigrateServerCertFile, err = ca.GenerateSelfSignedCertAndKey("server", []string{}, false)
+			Expect(err).NotTo(HaveOccurred())
+
+			otherCfg := cfg
+			otherCfg.NATSMigrateServerKeyFile, otherCfg.NATSMigrateServerCertFile, err = ca.GenerateSelfSignedCertAndKey("other", []string{"migrate-client.example.com"}, false)
+			Expect(err).NotTo(HaveOccurred())
+			otherClient = CreateTLSClient(otherCfg)
+		})
+
+		JustBeforeEach(func() {
+			StartServer(cfg)
+			client = CreateTLSClient(cfg)
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(certDepoDir)
+		})
+
+		get := func(c http.Client, path string) int {
+			resp, err := c.Get(fmt.Sprintf("https://%s%s", address, path))
+			Expect(err).NotTo(HaveOccurred())
+			resp.Body.Close()
+			return resp.StatusCode
+		}
+
+		post := func(c http.Client, path string) int {
+			resp, err := c.Post(fmt.Sprintf("https://%s%s", address, path), "application/json", nil)
+			Expect(err).NotTo(HaveOccurred())
+			resp.Body.Close()
+			return resp.StatusCode
+		}
+
+		Context("without an allowlist", func() {
+			It("allows every client signed by the CA", func() {
+				Expect(get(client, "/info")).To(Equal(http.StatusOK))
+				Expect(get(otherClient, "/info")).To(Equal(http.StatusOK))
+			})
+		})
+
+		Context("with an allowlist for all endpoints", func() {
+			BeforeEach(func() {
+				cfg.NATSMigrateAuthorizedClients = map[string][]string{"*": {"server"}}
+			})
+
+			It("allows the listed common name", func() {
+				Expect(get(client, "/info")).To(Equal(http.StatusOK))
+				Expect(get(client, "/status")).To(Equal(http.StatusOK))
+			})
+
+			It("rejects other clients and audits the rejection", func() {
+				Expect(get(otherClient, "/info")).To(Equal(http.StatusForbidden))
+				Eventually(session.Out).Should(gbytes.Say(`audit.rejected-unauthorized-client.*"identities":\["other","migrate-client.example.com","127.0.0.1"\].*"method":"GET","path":"/info"`))
+			})
+		})
+
+		Context("with an allowlist per endpoint", func() {
+			BeforeEach(func() {
+				cfg.NATSMigrateAuthorizedClients = map[string][]string{
+					"/migrate": {"migrate-client.example.com"},
+					"*":        {"server"},
+				}
+			})
+
+			It("allows the clients listed for the endpoint by SAN", func() {
+				Expect(post(otherClient, "/migrate")).To(Equal(http.StatusOK))
+				Expect(get(otherClient, "/info")).To(Equal(http.StatusForbidden))
+			})
+
+			It("rejects clients only listed for other endpoints", func() {
+				Expect(post(client, "/migrate")).To(Equal(http.StatusForbidden))
+				Expect(get(client, "/info")).To(Equal(http.StatusOK))
+			})
+		})
+
+		Context("with an allowlist without an entry for all endpoints", func() {
+			BeforeEach(func() {
+				cfg.NATSMigrateAuthorizedClients = map[string][]string{"/migrate": {"server"}}
+			})
+
+			It("rejects every client on the other endpoints", func() {
+				Expect(get(client, "/info")).To(Equal(http.StatusForbidden))
+				Expect(post(client, "/migrate")).To(Equal(http.StatusOK))
+			})
+		})
+	})
+
+	Describe("/migrate/status", func() {
+		var natsRunner1 *helpers.NATSRunner
+
+		BeforeEach(func() {
+			natsRunner1 = helpers.NewNATSRunner(int(natsRunnerPort1))
+			natsRunner1.StartV1()
+
+			cfg = config.Config{
+				Bootstrap:       true,
+				NATSMigratePort: int(natsMigratorPort),
+				Address:         "127.0.0.1",
+				NATSPort:        int(natsPort),
+				NATSInstances: []string{
+					fmt.Sprintf("127.0.0.1:%d", natsPort),
+					natsRunner1.Addr(),
+				},
+				NATSV1BinPath: natsV1File,
+				NATSV2BinPath: natsV2File,
+			}
+			GenerateCerts(&cfg)
+		})
+
+		AfterEach(func() {
+			natsRunner1.Stop()
+		})
+
+		post := func(path string) (int, map[string]interface{}) {
+			resp, err := client.Post(fmt.Sprintf("https://%s%s", address, path), "application/json", nil)
+			Expect(err).ToNot(HaveOccurred())
+			defer resp.Body.Close()
+			var status map[string]interface{}
+			body, err := io.ReadAll(resp.Body)
+			Expect(err).ToNot(HaveOccurred())
+			if len(body) > 0 {
+				Expect(json.Unmarshal(body, &status)).To(Succeed())
+			}
+			return resp.StatusCode, status
+		}
+
+		getMigrateStatus := func() map[string]interface{} {
+			resp, err := client.Get(fmt.Sprintf("https://%s/migrate/status", address))
+			Expect(err).ToNot(HaveOccurred())
+			defer resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			var status map[string]interface{}
+			Expect(json.NewDecoder(resp.Body).Decode(&status)).To(Succeed())
+			return status
+		}
+
+		Context("when the migration succeeds", func() {
+			BeforeEach(func() {
+				StartServer(cfg)
+				client = CreateTLSClient(cfg)
+			})
+
+			It("is idle before the first migration", func() {
+				Expect(getMigrateStatus()).To(Equal(map[string]interface{}{"state": "idle"}))
+			})
+
+			It("only migrates on POST", func() {
+				resp, err := client.Get(fmt.Sprintf("https://%s/migrate", address))
+				Expect(err).ToNot(HaveOccurred())
+				resp.Body.Close()
+				Expect(resp.StatusCode).To(Equal(http.StatusMethodNotAllowed))
+				Expect(resp.Header.Get("Allow")).To(Equal(http.MethodPost))
+
+				resp, err = client.Head(fmt.Sprintf("https://%s/migrate", address))
+				Expect(err).ToNot(HaveOccurred())
+				resp.Body.Close()
+				Expect(resp.StatusCode).To(Equal(http.StatusMethodNotAllowed))
+
+				Expect(getMigrateStatus()).To(Equal(map[string]interface{}{"state": "idle"}))
+				Expect(string(session.Out.Contents())).NotTo(ContainSubstring("received-migrate-api-call"))
+			})
+
+			It("reports who migrated to which binary and when", func() {
+				statusCode, status := post("/migrate")
+				Expect(statusCode).To(Equal(http.StatusOK))
+				Expect(status["state"]).To(Equal("succeeded"))
+
+				status = getMigrateStatus()
+				Expect(status["state"]).To(Equal("succeeded"))
+				Expect(status["target"]).To(Equal("v2"))
+				Expect(status["requested_by"]).To(Equal("server"))
+				Expect(status["started_at"]).NotTo(BeEmpty())
+				Expect(status["finished_at"]).NotTo(BeEmpty())
+				Expect(status).NotTo(HaveKey("error"))
+			})
+
+			It("reports a rollback", func() {
+				statusCode, _ := post("/migrate")
+				Expect(statusCode).To(Equal(http.StatusOK))
+				statusCode, _ = post("/rollback")
+				Expect(statusCode).To(Equal(http.StatusOK))
+
+				status := getMigrateStatus()
+				Expect(status["state"]).To(Equal("rolled-back"))
+				Expect(status["target"]).To(Equal("v1"))
+			})
+
+			It("only rolls back on POST", func() {
+				statusCode, _ := post("/migrate")
+				Expect(statusCode).To(Equal(http.StatusOK))
+
+				resp, err := client.Get(fmt.Sprintf("https://%s/rollback", address))
+				Expect(err).ToNot(HaveOccurred())
+				resp.Body.Close()
+				Expect(resp.StatusCode).To(Equal(http.StatusMethodNotAllowed))
+				Expect(resp.Header.Get("Allow")).To(Equal(http.MethodPost))
+
+				Expect(getMigrateStatus()["state"]).To(Equal("succeeded"))
+				Expect(string(session.Out.Contents())).NotTo(ContainSubstring("received-rollback-signal"))
+			})
+		})
+
+		Context("when the migration fails", func() {
+			BeforeEach(func() {
+				// v2 never accepts connections
+				cfg.NATSReadinessTimeout = config.Duration(3 * time.Second)
+				StartServer(cfg)
+				client = CreateTLSClient(cfg)
+			})
+
+			It("reports the migration in progress and then the error", func() {
+				finished := make(chan int, 1)
+				go func() {
+					defer GinkgoRecover()
+					statusCode, _ := post("/migrate")
+					finished <- statusCode
+				}()
+
+				Eventually(func() interface{} { return getMigrateStatus()["state"] }).Should(Equal("in-progress"))
+
+				statusCode, status := post("/migrate")
+				Expect(statusCode).To(Equal(http.StatusConflict))
+				Expect(status["state"]).To(Equal("in-progress"))
+
+				statusCode, _ = post("/rollback")
+				Expect(statusCode).To(Equal(http.StatusConflict))
+
+				Eventually(finished, 10).Should(Receive(Equal(http.StatusInternalServerError)))
+				status = getMigrateStatus()
+				Expect(status["state"]).To(Equal("failed"))
+				Expect(status["error"]).To(ContainSubstring("nats did not become ready within 3s"))
+				Expect(status["finished_at"]).NotTo(BeEmpty())
+			})
+
+			It("refuses to migrate while a rollback is in progress", func() {
+				statusCode, _ := post("/migrate")
+				Expect(statusCode).To(Equal(http.StatusInternalServerError))
+
+				// v1 does not become ready either, which keeps the rollback busy
+				finished := make(chan int, 1)
+				go func() {
+					defer GinkgoRecover()
+					statusCode, _ := post("/rollback")
+					finished <- statusCode
+				}()
+
+				Eventually(func() interface{} { return getMigrateStatus()["state"] }).Should(Equal("rolling-back"))
+
+				statusCode, status := post("/migrate")
+				Expect(statusCode).To(Equal(http.StatusConflict))
+				Expect(status["state"]).To(Equal("rolling-back"))
+
+				statusCode, _ = post("/rollback")
+				Expect(statusCode).To(Equal(http.StatusConflict))
+
+				Eventually(finished, 10).Should(Receive(Equal(http.StatusInternalServerError)))
+				status = getMigrateStatus()
+				Expect(status["state"]).To(Equal("rollback-failed"))
+				Expect(status["target"]).To(Equal("v1"))
+				Expect(status["error"]).To(ContainSubstring("nats did not become ready within 3s"))
+			})
+
+			It("can be retried", func() {
+				statusCode, _ := post("/migrate")
+				Expect(statusCode).To(Equal(http.StatusInternalServerError))
+
+				statusCode, status := post("/migrate")
+				Expect(statusCode).To(Equal(http.StatusInternalServerError))
+				Expect(status["state"]).To(Equal("failed"))
+			})
+		})
+	})
+
+	Describe("readiness after switching binaries", func() {
+		var (
+			natsRunner1 *helpers.NATSRunner
+			pidFile     string
+		)
+
+		BeforeEach(func() {
+			natsRunner1 = helpers.NewNATSRunner(int(natsRunnerPort1))
+			natsRunner1.StartV1()
+
+			file, err := os.CreateTemp("", "nats-pid-")
+			Expect(err).NotTo(HaveOccurred())
+			pidFile = file.Name()
+
+			cfg = config.Config{
+				Bootstrap:       true,
+				NATSMigratePort: int(natsMigratorPort),
+				Address:         "127.0.0.1",
+				NATSPort:        int(natsPort),
+				NATSInstances: []string{
+					fmt.Sprintf("127.0.0.1:%d", natsPort),
+					natsRunner1.Addr(),
+				},
+				NATSV1BinPath:        natsV1File,
+				NATSV2BinPath:        natsV2File,
+				NATSReadinessTimeout: config.Duration(2 * time.Second),
+			}
+			GenerateCerts(&cfg)
+		})
+
+		AfterEach(func() {
+			natsRunner1.Stop()
+
+			// the real nats-server outlives the killed wrapper
+			content, err := os.ReadFile(pidFile)
+			if err == nil && len(content) > 0 {
+				pid, err := strconv.Atoi(strings.TrimSpace(string(content)))
+				Expect(err).NotTo(HaveOccurred())
+				if process, err := os.FindProcess(pid); err == nil {
+					process.Kill()
+				}
+			}
+			os.Remove(pidFile)
+		})
+
+		migrate := func() *http.Response {
+			resp, err := client.Post(fmt.Sprintf("https://%s/migrate", address), "application/json", nil)
+			Expect(err).ToNot(HaveOccurred())
+			return resp
+		}
+
+		getStatus := func() map[string]interface{} {
+			resp, err := client.Get(fmt.Sprintf("https://%s/status", address))
+			Expect(err).ToNot(HaveOccurred())
+			defer resp.Body.Close()
+			var status map[string]interface{}
+			Expect(json.NewDecoder(resp.Body).Decode(&status)).To(Succeed())
+			return status
+		}
+
+		Context("when v2 accepts connections", func() {
+			BeforeEach(func() {
+				helpers.MockNATS{
+					Version:    "v2",
+					OutputFile: outputFile,
+					PidFile:    pidFile,
+					Exec:       helpers.Build("github.com/nats-io/nats-server/v2"),
+					ExecArgs:   []string{"-p", strconv.Itoa(int(natsPort))},
+				}.Write(natsV2File)
+				StartServer(cfg)
+				client = CreateTLSClient(cfg)
+			})
+
+			It("reports success once v2 answers PING", func() {
+				resp := migrate()
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				Eventually(session.Out).Should(gbytes.Say("nats-is-ready"))
+
+				status := getStatus()
+				Expect(status["migration"]).To(Equal("migrated"))
+				Expect(status["version"]).To(HavePrefix("2."))
+			})
+		})
+
+		Context("when v2 requires authorization", func() {
+			BeforeEach(func() {
+				helpers.MockNATS{
+					Version:    "v2",
+					OutputFile: outputFile,
+					PidFile:    pidFile,
+					Exec:       helpers.Build("github.com/nats-io/nats-server/v2"),
+					ExecArgs:   []string{"-p", strconv.Itoa(int(natsPort)), "--user", "nats-user", "--pass", "nats-password"},
+				}.Write(natsV2File)
+			})
+
+			It("pings v2 with the nats credentials", func() {
+				cfg.NATSUser = "nats-user"
+				cfg.NATSPassword = "nats-password"
+				StartServer(cfg)
+				client = CreateTLSClient(cfg)
+
+				resp := migrate()
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				Eventually(session.Out).Should(gbytes.Say("nats-is-ready"))
+				Expect(getStatus()["migration"]).To(Equal("migrated"))
+			})
+
+			It("fails the migration without the nats credentials", func() {
+				StartServer(cfg)
+				client = CreateTLSClient(cfg)
+
+				resp := migrate()
+				Expect(resp.StatusCode).To(Equal(http.StatusInternalServerError))
+				Eventually(session.Out).Should(gbytes.Say("nats-did-not-become-ready.*Authorization Violation"))
+			})
+		})
+
+		Context("when v2 never accepts connections", func() {
+			BeforeEach(func() {
+				StartServer(cfg)
+				client = CreateTLSClient(cfg)
+			})
+
+			It("fails the migration", func() {
+				resp := migrate()
+				Expect(resp.StatusCode).To(Equal(http.StatusInternalServerError))
+				Eventually(session.Out).Should(gbytes.Say("nats-did-not-become-ready.*nats did not become ready within 2s"))
+
+				status := getStatus()
+				Expect(status["binary"]).To(Equal("v2"))
+				Expect(status["migration"]).To(Equal("failed"))
+			})
+		})
+
+		Context("when v2 does not re-establish its routes", func() {
+			BeforeEach(func() {
+				node := GinkgoParallelProcess()
+				allocator, err := portauthority.New(1000*node+950, 1000*node+999)
+				Expect(err).NotTo(HaveOccurred())
+				monitorPort, err := allocator.ClaimPorts(1)
+				Expect(err).NotTo(HaveOccurred())
+
+				cfg.NATSMonitorPort = int(monitorPort)
+				helpers.MockNATS{
+					Version:    "v2",
+					OutputFile: outputFile,
+					PidFile:    pidFile,
+					Exec:       helpers.Build("github.com/nats-io/nats-server/v2"),
+					ExecArgs:   []string{"-p", strconv.Itoa(int(natsPort)), "-m", strconv.Itoa(int(monitorPort))},
+				}.Write(natsV2File)
+				StartServer(cfg)
+				client = CreateTLSClient(cfg)
+			})
+
+			It("fails the migration with the missing routes", func() {
+				resp := migrate()
+				Expect(resp.StatusCode).To(Equal(http.StatusInternalServerError))
+				Eventually(session.Out).Should(gbytes.Say("nats-did-not-become-ready.*0 of 1 expected routes established"))
+				Expect(getStatus()["migration"]).To(Equal("failed"))
+			})
+		})
+	})
+
+	Describe("migration state", func() {
+		var (
+			natsRunner1 *helpers.NATSRunner
+			stateFile   string
+		)
+
+		BeforeEach(func() {
+			natsRunner1 = helpers.NewNATSRunner(int(natsRunnerPort1))
+			natsRunner1.StartV1()
+
+			stateDir, err := os.MkdirTemp("", "nats-state-")
+			Expect(err).NotTo(HaveOccurred())
+			stateFile = filepath.Join(stateDir, "migration-state.json")
+
+			cfg = config.Config{
+				Bootstrap:       true,
+				NATSMigratePort: int(natsMigratorPort),
+				Address:         "127.0.0.1",
+				NATSPort:        int(natsPort),
+				NATSInstances: []string{
+					fmt.Sprintf("127.0.0.1:%d", natsPort),
+					natsRunner1.Addr(),
+				},
+				NATSV1BinPath: natsV1File,
+				NATSV2BinPath: natsV2File,
+				NATSStateFile: stateFile,
+			}
+			GenerateCerts(&cfg)
+		})
+
+		AfterEach(func() {
+			natsRunner1.Stop()
+			os.RemoveAll(filepath.Dir(stateFile))
+		})
+
+		writeState := func(binary string) {
+			err := os.WriteFile(stateFile, []byte(`{"binary":"`+binary+`","changed_at":"2024-01-02T03:04:05Z","reason":"migrate-request"}`), 0644)
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		readOutput := func() string {
+			content, _ := os.ReadFile(outputFile)
+			return string(content)
+		}
+
+		It("records the binary after a migration", func() {
+			StartServer(cfg)
+			client = CreateTLSClient(cfg)
+
+			resp, err := client.Post(fmt.Sprintf("https://%s/migrate", address), "application/json", nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+			content, err := os.ReadFile(stateFile)
+			Expect(err).NotTo(HaveOccurred())
+			var state map[string]interface{}
+			Expect(json.Unmarshal(content, &state)).To(Succeed())
+			Expect(state["binary"]).To(Equal("v2"))
+			Expect(state["reason"]).To(Equal("migrate-request"))
+			Expect(state["changed_at"]).NotTo(BeEmpty())
+		})
+
+		It("records the binary after a rollback", func() {
+			writeState("v2")
+			StartServer(cfg)
+			client = CreateTLSClient(cfg)
+
+			resp, err := client.Post(fmt.Sprintf("https://%s/rollback", address), "application/json", nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+			content, err := os.ReadFile(stateFile)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(content)).To(ContainSubstring(`"binary":"v1"`))
+			Expect(string(content)).To(ContainSubstring(`"reason":"rollback-request"`))
+		})
+
+		It("starts the recorded binary although a peer still runs v1", func() {
+			writeState("v2")
+			StartServer(cfg)
+
+			Eventually(session.Out).Should(gbytes.Say(`found-migration-state.*"binary":"v2"`))
+			Eventually(readOutput).Should(ContainSubstring("v2"))
+			Expect(readOutput()).NotTo(ContainSubstring("v1"))
+		})
+
+		It("probes the peers when the state file cannot be parsed", func() {
+			Expect(os.WriteFile(stateFile, []byte("{"), 0644)).To(Succeed())
+			StartServer(cfg)
+
+			Eventually(session.Out).Should(gbytes.Say("ignoring-unreadable-migration-state"))
+			Eventually(session.Out).Should(gbytes.Say(`selected-binary-from-peers.*"binary":"v1"`))
+		})
+
+		Context("with a binary override", func() {
+			BeforeEach(func() {
+				cfg.NATSBinaryOverride = "v1"
+				writeState("v2")
+			})
+
+			It("starts the override regardless of the recorded state", func() {
+				StartServer(cfg)
+
+				Eventually(session.Out).Should(gbytes.Say(`binary-override.*"binary":"v1"`))
+				Eventually(readOutput).Should(ContainSubstring("v1"))
+			})
+		})
+
+		Context("with an invalid binary override", func() {
+			BeforeEach(func() {
+				cfg.NATSBinaryOverride = "v3"
+			})
+
+			It("exits with an error", func() {
+				StartServerWithoutWaiting(cfg)
+
+				Eventually(session, 10).Should(gexec.Exit(2))
+				Expect(session.Out).To(gbytes.Say(`invalid nats_binary_override \\"v3\\"`))
+			})
+		})
+
+		Context("when asked to reset the state", func() {
+			It("removes the state file and exits", func() {
+				writeState("v2")
+				StartServerWithoutWaiting(cfg, "-reset-state")
+
+				Eventually(session, 10).Should(gexec.Exit(0))
+				Expect(session.Out).To(gbytes.Say("reset-migration-state"))
+				Expect(stateFile).NotTo(BeAnExistingFile())
+			})
+
+			It("succeeds when there is no state file", func() {
+				StartServerWithoutWaiting(cfg, "-reset-state")
+
+				Eventually(session, 10).Should(gexec.Exit(0))
+			})
+		})
+	})
+
+	Describe("named binaries", func() {
+		var (
+			natsRunner1 *helpers.NATSRunner
+			nats211File string
+		)
+
+		BeforeEach(func() {
+			natsRunner1 = helpers.NewNATSRunner(int(natsRunnerPort1))
+			natsRunner1.Start()
+
+			file, err := os.CreateTemp("", "nats-2.11-sh-")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(file.Close()).To(Succeed())
+			nats211File = file.Name()
+			helpers.MockNATS{Version: "2.10", OutputFile: outputFile}.Write(natsV2File)
+			helpers.MockNATS{Version: "2.11", OutputFile: outputFile}.Write(nats211File)
+
+			cfg = config.Config{
+				Bootstrap:       true,
+				NATSMigratePort: int(natsMigratorPort),
+				Address:         "127.0.0.1",
+				NATSPort:        int(natsPort),
+				NATSInstances: []string{
+					fmt.Sprintf("127.0.0.1:%d", natsPort),
+					natsRunner1.Addr(),
+				},
+				NATSBinaries: config.NATSBinaries{
+					{Name: "gnatsd", BinPath: natsV1File, Version: "<2"},
+					{Name: "2.10", BinPath: natsV2File, Version: ">=2.10.0 <2.11.0"},
+					{Name: "2.11", BinPath: nats211File, Version: ">=2.11.0"},
+				},
+			}
+			GenerateCerts(&cfg)
+			StartServer(cfg)
+			client = CreateTLSClient(cfg)
+		})
+
+		AfterEach(func() {
+			natsRunner1.Stop()
+			os.Remove(nats211File)
+		})
+
+		readOutput := func() string {
+			content, _ := os.ReadFile(outputFile)
+			return string(content)
+		}
+
+		migrate := func(body string) int {
+			resp, err := client.Post(fmt.Sprintf("https://%s/migrate", address), "application/json", strings.NewReader(body))
+			Expect(err).ToNot(HaveOccurred())
+			return resp.StatusCode
+		}
+
+		It("starts as the binary that matches the oldest peer", func() {
+			Eventually(session.Out).Should(gbytes.Say(`selected-binary-from-peers","data":{"binary":"2.10","min_responses":0,"peers":{"` + natsRunner1.Addr() + `":"2.10"},"policy":"all-reachable","responses":1}`))
+			Eventually(readOutput).Should(ContainSubstring("2.10"))
+		})
+
+		It("migrates to the target in the request", func() {
+			Expect(migrate(`{"target":"2.11"}`)).To(Equal(http.StatusOK))
+			Eventually(readOutput).Should(ContainSubstring("2.11"))
+			Eventually(session.Out).Should(gbytes.Say(`migrated.*"from":"2.10","to":"2.11"`))
+		})
+
+		It("migrates to the newest binary without a target", func() {
+			Expect(migrate("")).To(Equal(http.StatusOK))
+			Eventually(readOutput).Should(ContainSubstring("2.11"))
+		})
+
+		It("rejects an unknown target", func() {
+			Expect(migrate(`{"target":"3.0"}`)).To(Equal(http.StatusBadRequest))
+			Eventually(session.Out).Should(gbytes.Say("invalid-migrate-request.*there is no nats binary called 3.0"))
+
+			Expect(migrate(`{"target":"2.11"}`)).To(Equal(http.StatusOK))
+		})
+
+		It("rolls back to the previous binary", func() {
+			Expect(migrate(`{"target":"2.11"}`)).To(Equal(http.StatusOK))
+
+			resp, err := client.Post(fmt.Sprintf("https://%s/rollback", address), "application/json", nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Eventually(readOutput).Should(ContainSubstring("2.10"))
+			Eventually(session.Out).Should(gbytes.Say(`rolled-back.*"from":"2.11","to":"2.10"`))
+		})
+	})
+
+	Describe("supervision", func() {
+		BeforeEach(func() {
+			cfg = config.Config{
+				NATSInstances:             []string{fmt.Sprintf("127.0.0.1:%d", natsPort)},
+				Bootstrap:                 true,
+				NATSMigratePort:           int(natsMigratorPort),
+				NATSV1BinPath:             natsV1File,
+				NATSV2BinPath:             natsV2File,
+				NATSSupervise:             true,
+				NATSRestartInitialBackoff: config.Duration(100 * time.Millisecond),
+				NATSRestartMaxBackoff:     config.Duration(200 * time.Millisecond),
+				NATSRestartMaxRestarts:    2,
+				NATSRestartWindow:         config.Duration(time.Minute),
+			}
+			GenerateCerts(&cfg)
+		})
+
+		Context("when nats recovers after crashing", func() {
+			BeforeEach(func() {
+				helpers.MockNATS{
+					Version:      "v2",
+					OutputFile:   outputFile,
+					AppendOutput: true,
+					StderrLines:  []string{"fatal error: mock crash"},
+					ExitCode:     3,
+					Crashes:      2,
+				}.Write(natsV2File)
+				StartServerWithoutWaiting(cfg)
+			})
+
+			It("restarts it with the stderr of each crash in the logs", func() {
+				Eventually(func() string {
+					content, _ := os.ReadFile(outputFile)
+					return string(content)
+				}).Should(Equal("v2\nv2\nv2\n"))
+
+				Eventually(session.Out).Should(gbytes.Say(`nats-crashed.*"exit_code":3.*fatal error: mock crash`))
+				Eventually(session.Out).Should(gbytes.Say(`restarting-nats.*"backoff":"100ms"`))
+				Eventually(session.Out).Should(gbytes.Say(`restarting-nats.*"backoff":"200ms"`))
+				Eventually(session.Out).Should(gbytes.Say("restarted-nats"))
+				Consistently(session).ShouldNot(gexec.Exit())
+			})
+		})
+
+		Context("when nats keeps crashing", func() {
+			BeforeEach(func() {
+				helpers.MockNATS{
+					Version:      "v2",
+					OutputFile:   outputFile,
+					AppendOutput: true,
+					StderrLines:  []string{"fatal error: mock crash"},
+					ExitCode:     3,
+					Crashes:      10,
+				}.Write(natsV2File)
+				StartServerWithoutWaiting(cfg)
+			})
+
+			It("gives up after the maximum number of restarts", func() {
+				Eventually(session, 10*time.Second).Should(gexec.Exit(1))
+				Expect(session.Out).To(gbytes.Say("giving-up-restarting-nats.*nats crashed 3 times within 1m0s"))
+
+				content, err := os.ReadFile(outputFile)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(content)).To(Equal("v2\nv2\nv2\n"))
+			})
+		})
+	})
+
+	Describe("config reload", func() {
+		var (
+			reloadFile, natsConfigFile string
+			certFile, keyFile          string
+			logFile                    string
+		)
+
+		writeNATSConfig := func(port int) {
+			natsConfig := fmt.Sprintf(`port: %d
+log_file: "%s"
+tls: {
+  cert_file: "%s"
+  key_file: "%s"
+}
+`, port, logFile, certFile, keyFile)
+			Expect(os.WriteFile(natsConfigFile, []byte(natsConfig), 0644)).To(Succeed())
+		}
+
+		reloads := func() string {
+			content, _ := os.ReadFile(reloadFile)
+			return string(content)
+		}
+
+		BeforeEach(func() {
+			file, err := os.CreateTemp("", "reload-file-")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(os.Remove(file.Name())).To(Succeed())
+			reloadFile = file.Name()
+
+			file, err = os.CreateTemp("", "nats-conf-")
+			Expect(err).NotTo(HaveOccurred())
+			natsConfigFile = file.Name()
+
+			file, err = os.CreateTemp("", "nats-log-")
+			Expect(err).NotTo(HaveOccurred())
+			logFile = file.Name()
+
+			helpers.MockNATS{
+				Version:    "v2",
+				OutputFile: outputFile,
+				Traps:      map[string]string{"HUP": "echo reloaded >>" + reloadFile},
+			}.Write(natsV2File)
+
+			cfg = config.Config{
+				NATSInstances:            []string{fmt.Sprintf("127.0.0.1:%d", natsPort)},
+				Bootstrap:                true,
+				NATSMigratePort:          int(natsMigratorPort),
+				NATSV1BinPath:            natsV1File,
+				NATSV2BinPath:            natsV2File,
+				NATSConfigPath:           natsConfigFile,
+				NATSConfigWatchInterval:  config.Duration(100 * time.Millisecond),
+				NATSConfigReloadDebounce: config.Duration(300 * time.Millisecond),
+			}
+			GenerateCerts(&cfg)
+			certFile, keyFile = cfg.NATSMigrateServerCertFile, cfg.NATSMigrateServerKeyFile
+			writeNATSConfig(4222)
+			StartServer(cfg)
+			Eventually(session.Out).Should(gbytes.Say("config-watcher.watching"))
+		})
+
+		AfterEach(func() {
+			os.Remove(reloadFile)
+			os.Remove(natsConfigFile)
+			os.Remove(logFile)
+		})
+
+		It("reloads nats once after the config changed", func() {
+			Consistently(reloads, "500ms").Should(BeEmpty())
+
+			writeNATSConfig(4223)
+			writeNATSConfig(4224)
+
+			Eventually(reloads).Should(Equal("reloaded\n"))
+			Eventually(session.Out).Should(gbytes.Say("reloaded-nats"))
+			Consistently(reloads, "1s").Should(Equal("reloaded\n"))
+		})
+
+		It("reloads nats when a referenced certificate changes", func() {
+			cert, err := os.ReadFile(certFile)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(os.WriteFile(certFile, append(cert, '\n'), 0644)).To(Succeed())
+
+			Eventually(reloads).Should(Equal("reloaded\n"))
+		})
+
+		It("does not reload nats when the log file it writes changes", func() {
+			Expect(string(session.Out.Contents())).NotTo(ContainSubstring(logFile))
+
+			for i := 0; i < 5; i++ {
+				Expect(os.WriteFile(logFile, []byte(fmt.Sprintf("log line %d\n", i)), 0644)).To(Succeed())
+				time.Sleep(200 * time.Millisecond)
+			}
+
+			Consistently(reloads, "1s").Should(BeEmpty())
+			Expect(string(session.Out.Contents())).NotTo(ContainSubstring("detected-change"))
+		})
+
+		It("does not reload nats when the new config is invalid", func() {
+			Expect(os.WriteFile(keyFile, []byte("not a key"), 0644)).To(Succeed())
+
+			Eventually(session.Out).Should(gbytes.Say("skipping-reload-invalid-config"))
+			Consistently(reloads, "1s").Should(BeEmpty())
+		})
+	})
+
+	Describe("forwarding signals", func() {
+		var signalsFile string
+
+		signals := func() string {
+			content, _ := os.ReadFile(signalsFile)
+			return string(content)
+		}
+
+		BeforeEach(func() {
+			file, err := os.CreateTemp("", "signals-file-")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(os.Remove(file.Name())).To(Succeed())
+			signalsFile = file.Name()
+
+			helpers.MockNATS{
+				Version:    "v2",
+				OutputFile: outputFile,
+				Traps: map[string]string{
+					"HUP":  "echo HUP >>" + signalsFile,
+					"USR1": "echo USR1 >>" + signalsFile,
+					"USR2": "echo USR2 >>" + signalsFile + "; " + helpers.ExitOnSignal,
+				},
+			}.Write(natsV2File)
+
+			cfg = config.Config{
+				NATSInstances:   []string{fmt.Sprintf("127.0.0.1:%d", natsPort)},
+				Bootstrap:       true,
+				NATSMigratePort: int(natsMigratorPort),
+				NATSV1BinPath:   natsV1File,
+				NATSV2BinPath:   natsV2File,
+			}
+			GenerateCerts(&cfg)
+			StartServer(cfg)
+			Eventually(func() string {
+				content, _ := os.ReadFile(outputFile)
+				return string(content)
+			}).Should(ContainSubstring("v2"))
+		})
+
+		AfterEach(func() {
+			os.Remove(signalsFile)
+		})
+
+		It("passes reload and log reopen signals to nats and keeps running", func() {
+			session.Signal(syscall.SIGHUP)
+			Eventually(signals).Should(Equal("HUP\n"))
+			Eventually(session.Out).Should(gbytes.Say(`forwarded-signal-to-nats.*"signal":"hangup"`))
+
+			session.Signal(syscall.SIGUSR1)
+			Eventually(signals).Should(Equal("HUP\nUSR1\n"))
+
+			Consistently(session, "500ms").ShouldNot(gexec.Exit())
+		})
+
+		It("exits when nats finishes the lame duck mode it was signalled into", func() {
+			session.Signal(syscall.SIGUSR2)
+
+			Eventually(session, 5*time.Second).Should(gexec.Exit(0))
+			Expect(signals()).To(Equal("USR2\n"))
+			Expect(session.Out).To(gbytes.Say("exited-nats"))
+		})
+	})
+
+	Describe("metrics", func() {
+		var (
+			pidFile     string
+			monitorPort uint16
+		)
+
+		// the metrics server starts after the migrate server
+		scrape := func() (string, error) {
+			resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/metrics", natsRunnerPort1))
+			if err != nil {
+				return "", err
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				return "", fmt.Errorf("unexpected status code %d", resp.StatusCode)
+			}
+			if contentType := resp.Header.Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain; version=0.0.4") {
+				return "", fmt.Errorf("unexpected content type %q", contentType)
+			}
+			body, err := io.ReadAll(resp.Body)
+			return string(body), err
+		}
+
+		BeforeEach(func() {
+			file, err := os.CreateTemp("", "nats-pid-")
+			Expect(err).NotTo(HaveOccurred())
+			pidFile = file.Name()
+
+			node := GinkgoParallelProcess()
+			allocator, err := portauthority.New(1000*node+950, 1000*node+999)
+			Expect(err).NotTo(HaveOccurred())
+			monitorPort, err = allocator.ClaimPorts(1)
+			Expect(err).NotTo(HaveOccurred())
+
+			helpers.MockNATS{
+				Version:    "v2",
+				OutputFile: outputFile,
+				PidFile:    pidFile,
+				Exec:       helpers.Build("github.com/nats-io/nats-server/v2"),
+				ExecArgs:   []string{"-p", strconv.Itoa(int(natsPort)), "-m", strconv.Itoa(int(monitorPort))},
+			}.Write(natsV2File)
+
+			cfg = config.Config{
+				Bootstrap:       true,
+				NATSMigratePort: int(natsMigratorPort),
+				Address:         "127.0.0.1",
+				NATSPort:        int(natsPort),
+				NATSInstances:   []string{fmt.Sprintf("127.0.0.1:%d", natsPort)},
+				NATSV1BinPath:   natsV1File,
+				NATSV2BinPath:   natsV2File,
+				NATSMetricsPort: int(natsRunnerPort1),
+			}
+			GenerateCerts(&cfg)
+		})
+
+		AfterEach(func() {
+			// the real nats-server outlives the killed wrapper
+			content, err := os.ReadFile(pidFile)
+			if err == nil && len(content) > 0 {
+				pid, err := strconv.Atoi(strings.TrimSpace(string(content)))
+				Expect(err).NotTo(HaveOccurred())
+				if process, err := os.FindProcess(pid); err == nil {
+					process.Kill()
+				}
+			}
+			os.Remove(pidFile)
+		})
+
+		Context("with a nats monitor port", func() {
+			BeforeEach(func() {
+				cfg.NATSMonitorPort = int(monitorPort)
+				StartServer(cfg)
+			})
+
+			It("serves the nats monitoring data and the wrapper state", func() {
+				var conn *nats.Conn
+				Eventually(func() error {
+					var err error
+					conn, err = nats.Connect(fmt.Sprintf("nats://127.0.0.1:%d", natsPort))
+					return err
+				}).Should(Succeed())
+				defer conn.Close()
+				_, err := conn.SubscribeSync("metrics.test")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(conn.Publish("metrics.test", []byte("hello"))).To(Succeed())
+				Expect(conn.Flush()).To(Succeed())
+
+				Eventually(scrape).Should(ContainSubstring("\nnats_up 1\n"))
+				metrics, err := scrape()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(metrics).To(ContainSubstring("# TYPE nats_server_in_msgs_total counter\n"))
+				Expect(metrics).To(MatchRegexp(`\nnats_server_connections [1-9]`))
+				Expect(metrics).To(MatchRegexp(`\nnats_server_in_msgs_total [1-9]`))
+				Expect(metrics).To(MatchRegexp(`\nnats_server_in_bytes_total [1-9]`))
+				Expect(metrics).To(MatchRegexp(`\nnats_server_subscriptions [1-9]`))
+				Expect(metrics).To(ContainSubstring("\nnats_server_slow_consumers_total 0\n"))
+				Expect(metrics).To(ContainSubstring("\nnats_server_routes 0\n"))
+				Expect(metrics).To(ContainSubstring("\nnats_wrapper_nats_running 1\n"))
+				Expect(metrics).To(ContainSubstring("\nnats_wrapper_nats_restarts_total 0\n"))
+				Expect(metrics).To(ContainSubstring(fmt.Sprintf("\nnats_wrapper_binary_info{binary=\"v2\",bin_path=\"%s\"} 1\n", natsV2File)))
+				Expect(metrics).To(ContainSubstring("\nnats_wrapper_migration_state{state=\"not-needed\"} 1\n"))
+				Expect(metrics).To(ContainSubstring("\nnats_wrapper_migration_state{state=\"migrated\"} 0\n"))
+			})
+
+			It("reports nats as down when its monitoring endpoint fails", func() {
+				content, err := os.ReadFile(pidFile)
+				Expect(err).NotTo(HaveOccurred())
+				pid, err := strconv.Atoi(strings.TrimSpace(string(content)))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(syscall.Kill(pid, syscall.SIGSTOP)).To(Succeed())
+				defer syscall.Kill(pid, syscall.SIGCONT)
+
+				Eventually(scrape, 5*time.Second).Should(ContainSubstring("\nnats_up 0\n"))
+				Eventually(session.Out).Should(gbytes.Say("metrics.scraping-nats-failed"))
+			})
+		})
+
+		Context("without a nats monitor port", func() {
+			BeforeEach(func() {
+				StartServer(cfg)
+			})
+
+			It("serves only the wrapper metrics", func() {
+				Eventually(session.Out).Should(gbytes.Say("serving-only-wrapper-metrics-without-nats-monitor-port"))
+
+				Eventually(scrape).Should(ContainSubstring("\nnats_wrapper_nats_running 1\n"))
+				metrics, err := scrape()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(metrics).NotTo(ContainSubstring("nats_up"))
+				Expect(metrics).NotTo(ContainSubstring("nats_server_"))
+			})
+		})
+	})
+
+	Describe("config validation", func() {
+		var natsConfigFile string
+
+		writeNATSConfig := func(config string) {
+			Expect(os.WriteFile(natsConfigFile, []byte(config), 0644)).To(Succeed())
+		}
+
+		BeforeEach(func() {
+			file, err := os.CreateTemp("", "nats-conf-")
+			Expect(err).NotTo(HaveOccurred())
+			natsConfigFile = file.Name()
+
+			cfg = config.Config{
+				Bootstrap:       true,
+				NATSMigratePort: int(natsMigratorPort),
+				NATSInstances:   []string{fmt.Sprintf("127.0.0.1:%d", natsPort)},
+				NATSV1BinPath:   natsV1File,
+				NATSV2BinPath:   natsV2File,
+				NATSConfigPath:  natsConfigFile,
+			}
+			GenerateCerts(&cfg)
+
+			helpers.MockNATS{
+				Version:     "v2",
+				OutputFile:  outputFile,
+				CheckConfig: helpers.Build("github.com/nats-io/nats-server/v2"),
+			}.Write(natsV2File)
+		})
+
+		AfterEach(func() {
+			os.Remove(natsConfigFile)
+		})
+
+		It("does not start nats with a config it would reject", func() {
+			writeNATSConfig("port: 4222\nno_such_key: 1\n")
+
+			StartServerWithoutWaiting(cfg)
+			Eventually(session, 5*time.Second).Should(gexec.Exit(1))
+			Expect(session.Out).To(gbytes.Say(`invalid-nats-config.*nats config is invalid for v2: .*:2:1: unknown field \\"no_such_key\\"`))
+
+			_, err := os.Stat(outputFile)
+			Expect(os.IsNotExist(err)).To(BeTrue(), "nats should not have been started")
+		})
+
+		It("lets the binary check the config, so keys newer than the vendored nats-server are accepted", func() {
+			helpers.MockNATS{Version: "v2", OutputFile: outputFile}.Write(natsV2File)
+			writeNATSConfig("port: 4222\nno_such_key: 1\n")
+
+			StartServer(cfg)
+			Eventually(func() string {
+				content, _ := os.ReadFile(outputFile)
+				return string(content)
+			}).Should(Equal("v2\n"))
+		})
+
+		It("refuses to migrate to a binary that rejects the config and keeps the old one running", func() {
+			// gnatsd ignores lame_duck_duration, nats-server requires at least 30s
+			writeNATSConfig("port: 4222\nlame_duck_duration: \"10s\"\n")
+			cfg.NATSBinaryOverride = "v1"
+			StartServer(cfg)
+			client = CreateTLSClient(cfg)
+
+			resp, err := client.Post(fmt.Sprintf("https://%s/migrate", address), "application/json", nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(http.StatusInternalServerError))
+			Eventually(session.Out).Should(gbytes.Say(`refusing-migration-invalid-nats-config.*:2:1: invalid lame_duck_duration of 10s`))
+
+			resp, err = client.Get(fmt.Sprintf("https://%s/status", address))
+			Expect(err).ToNot(HaveOccurred())
+			defer resp.Body.Close()
+			var status map[string]interface{}
+			Expect(json.NewDecoder(resp.Body).Decode(&status)).To(Succeed())
+			Expect(status["binary"]).To(Equal("v1"))
+			Expect(status["running"]).To(BeTrue())
+
+			content, err := os.ReadFile(outputFile)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(content)).To(Equal("v1\n"))
+		})
+
+		It("does not pass SIGHUP on to nats when the config became invalid", func() {
+			signalsFile := outputFile + ".signals"
+			defer os.Remove(signalsFile)
+			helpers.MockNATS{
+				Version:    "v2",
+				OutputFile: outputFile,
+				Traps: map[string]string{
+					"HUP":  "echo HUP >>" + signalsFile,
+					"USR1": "echo USR1 >>" + signalsFile,
+					"USR2": "echo USR2 >>" + signalsFile + "; " + helpers.ExitOnSignal,
+				},
+				CheckConfig: helpers.Build("github.com/nats-io/nats-server/v2"),
+			}.Write(natsV2File)
+			writeNATSConfig("port: 4222\n")
+			StartServer(cfg)
+			Eventually(func() string {
+				content, _ := os.ReadFile(outputFile)
+				return string(content)
+			}).Should(ContainSubstring("v2"))
+
+			writeNATSConfig("port: \"not a port\"\n")
+			session.Signal(syscall.SIGHUP)
+			Eventually(session.Out).Should(gbytes.Say("skipping-reload-invalid-nats-config"))
+
+			writeNATSConfig("port: 4223\n")
+			session.Signal(syscall.SIGHUP)
+			Eventually(session.Out).Should(gbytes.Say("forwarded-signal-to-nats"))
+			Eventually(func() string {
+				content, _ := os.ReadFile(signalsFile)
+				return string(content)
+			}).Should(Equal("HUP\n"))
+		})
+	})
+
+	Describe("memory watchdog", func() {
+		BeforeEach(func() {
+			cfg = config.Config{
+				NATSInstances:        []string{fmt.Sprintf("127.0.0.1:%d", natsPort)},
+				Bootstrap:            true,
+				NATSMigratePort:      int(natsMigratorPort),
+				NATSV1BinPath:        natsV1File,
+				NATSV2BinPath:        natsV2File,
+				NATSMemCheckInterval: config.Duration(100 * time.Millisecond),
+			}
+			GenerateCerts(&cfg)
+		})
+
+		Context("when nats uses more memory than the alert limit", func() {
+			BeforeEach(func() {
+				cfg.NATSMemLimitAlert = "1 KB"
+				StartServer(cfg)
+			})
+
+			It("logs a warning and keeps nats running", func() {
+				Eventually(session.Out).Should(gbytes.Say(`memory-above-alert-limit.*"alert_limit":1024`))
+				Consistently(session, "500ms").ShouldNot(gexec.Exit())
+				Expect(string(session.Out.Contents())).NotTo(ContainSubstring("restarting-nats-above-memory-limit"))
+			})
+		})
+
+		Context("when nats uses more memory than the restart limit", func() {
+			var lameDuckFile string
+
+			BeforeEach(func() {
+				file, err := os.CreateTemp("", "lame-duck-file-")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(os.Remove(file.Name())).To(Succeed())
+				lameDuckFile = file.Name()
+
+				helpers.MockNATS{
+					Version:    "v2",
+					OutputFile: outputFile,
+					Traps:      map[string]string{"USR2": "echo v2 >" + lameDuckFile + "; " + helpers.ExitOnSignal},
+				}.Write(natsV2File)
+				cfg.NATSMemLimitRestart = "1 KB"
+				cfg.NATSLameDuckDuration = config.Duration(time.Second)
+				StartServer(cfg)
+			})
+
+			AfterEach(func() {
+				os.Remove(lameDuckFile)
+			})
+
+			It("restarts nats through lame duck mode", func() {
+				Eventually(session.Out).Should(gbytes.Say(`memory-above-restart-limit.*"restart_limit":1024`))
+				Eventually(session.Out).Should(gbytes.Say("entering-lame-duck-mode"))
+				Eventually(session.Out).Should(gbytes.Say("restarted-nats"))
+				Eventually(func() string {
+					content, _ := os.ReadFile(lameDuckFile)
+					return string(content)
+				}).Should(Equal("v2\n"))
+				Expect(session).NotTo(gexec.Exit())
+			})
+		})
+
+		Context("with a limit in the wrong format", func() {
+			BeforeEach(func() {
+				cfg.NATSMemLimitRestart = "100 potatoes"
+			})
+
+			It("exits with an error", func() {
+				StartServerWithoutWaiting(cfg)
+
+				Eventually(session, 10).Should(gexec.Exit(2))
+				Expect(session.Out).To(gbytes.Say(`invalid-memory-limits.*nats_mem_limit_restart: invalid memory limit \\"100 potatoes\\"`))
+			})
+		})
+	})
+
+	Describe("nats output", func() {
+		BeforeEach(func() {
+			helpers.MockNATS{
+				Version:      "v2",
+				OutputFile:   outputFile,
+				AppendOutput: true,
+				StderrLines: []string{
+					"[42] 2026/01/02 15:04:05.123456 [INF] Starting nats-server",
+					"[42] 2026/01/02 15:04:05.123456 [INF]   Version:  2.10.22",
+					"[42] 2026/01/02 15:04:05.123456 [WRN] mock warning",
+					"goroutine 1 [running]:",
+				},
+			}.Write(natsV2File)
+
+			cfg = config.Config{
+				NATSInstances:   []string{fmt.Sprintf("127.0.0.1:%d", natsPort)},
+				Bootstrap:       true,
+				NATSMigratePort: int(natsMigratorPort),
+				NATSV1BinPath:   natsV1File,
+				NATSV2BinPath:   natsV2File,
+			}
+			GenerateCerts(&cfg)
+		})
+
+		It("re-emits every line as lager JSON", func() {
+			StartServer(cfg)
+
+			Eventually(session.Out).Should(gbytes.Say(`"level":"info","source":"nats","message":"nats.output","data":{"binary":"v2","msg":"Starting nats-server","nats_level":"INF","nats_time":"2026-01-02T\d\d:\d\d:05.123456Z","pid":"42"}`))
+			Eventually(session.Out).Should(gbytes.Say(`"level":"info","source":"nats","message":"nats.output","data":{"binary":"v2","msg":"mock warning","nats_level":"WRN","nats_time":"2026-01-02T\d\d:\d\d:05.123456Z","pid":"42","version":"2.10.22"}`))
+			Eventually(session.Out).Should(gbytes.Say(`"level":"error","source":"nats","message":"nats.output","data":{"binary":"v2","msg":"goroutine 1 \[running\]:","version":"2.10.22"}`))
+			Expect(string(session.Err.Contents())).NotTo(ContainSubstring("mock warning"))
+		})
+
+		It("passes the output through as is when asked to", func() {
+			cfg.NATSLogPassthrough = true
+			StartServer(cfg)
+
+			Eventually(session.Err).Should(gbytes.Say(`\[42\] 2026/01/02 15:04:05.123456 \[WRN\] mock warning`))
+			Expect(string(session.Out.Contents())).NotTo(ContainSubstring("mock warning"))
+		})
+	})
+
+	Describe("orphaned nats", func() {
+		var (
+			pidFile string
+			orphan  *exec.Cmd
+		)
+
+		// natsRunning reports whether pid exists and is not a zombie, which
+		// nobody reaps in some containers.
+		natsRunning := func(pid int) bool {
+			stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+			if err != nil {
+				return false
+			}
+			return !strings.Contains(string(stat[strings.LastIndex(string(stat), ")"):]), ") Z ")
+		}
+
+		readOutput := func() string {
+			content, _ := os.ReadFile(outputFile)
+			return string(content)
+		}
+
+		readPid := func() int {
+			content, err := os.ReadFile(pidFile)
+			if err != nil {
+				return 0
+			}
+			pid, _ := strconv.Atoi(strings.TrimSpace(string(content)))
+			return pid
+		}
+
+		BeforeEach(func() {
+			helpers.MockNATS{Version: "v2", OutputFile: outputFile, AppendOutput: true}.Write(natsV2File)
+
+			dir, err := os.MkdirTemp("", "nats-pid-")
+			Expect(err).NotTo(HaveOccurred())
+			pidFile = filepath.Join(dir, "nats-server.pid")
+
+			cfg = config.Config{
+				NATSInstances:   []string{fmt.Sprintf("127.0.0.1:%d", natsPort)},
+				Bootstrap:       true,
+				NATSMigratePort: int(natsMigratorPort),
+				NATSV1BinPath:   natsV1File,
+				NATSV2BinPath:   natsV2File,
+				NATSPidFile:     pidFile,
+			}
+			GenerateCerts(&cfg)
+		})
+
+		AfterEach(func() {
+			if orphan != nil {
+				orphan.Process.Kill()
+				orphan.Wait()
+				orphan = nil
+			}
+			os.RemoveAll(filepath.Dir(pidFile))
+		})
+
+		// startOrphan starts nats the way the wrapper does and records it in
+		// the pidfile, like a wrapper that was killed afterwards.
+		startOrphan := func() int {
+			orphan = exec.Command(natsV2File, "-c", "")
+			Expect(orphan.Start()).To(Succeed())
+			Expect(os.WriteFile(pidFile, []byte(strconv.Itoa(orphan.Process.Pid)+"\n"), 0644)).To(Succeed())
+			Eventually(readOutput).Should(Equal("v2\n"))
+			return orphan.Process.Pid
+		}
+
+		It("records the pid of nats while it runs and stops nats when the wrapper is killed", func() {
+			StartServer(cfg)
+
+			Eventually(readPid).ShouldNot(BeZero())
+			pid := readPid()
+			Expect(natsRunning(pid)).To(BeTrue())
+
+			session.Kill()
+			Eventually(session).Should(gexec.Exit())
+			Eventually(func() bool { return natsRunning(pid) }, 5).Should(BeFalse())
+		})
+
+		It("terminates a nats left behind by a previous wrapper before starting nats", func() {
+			pid := startOrphan()
+
+			StartServer(cfg)
+
+			Eventually(session.Out).Should(gbytes.Say(`"message":"nats-migrate-server.orphan-check.terminating-orphaned-nats","data":{"bin_path":"` + natsV2File + `","pid":` + strconv.Itoa(pid) + `,"pid_file":"` + pidFile + `","policy":"terminate"`))
+			Eventually(session.Out).Should(gbytes.Say("nats-migrate-server.orphan-check.terminated-orphaned-nats"))
+			Expect(natsRunning(pid)).To(BeFalse())
+			Eventually(readOutput).Should(Equal("v2\nv2\n"))
+			Eventually(readPid).ShouldNot(Equal(pid))
+		})
+
+		It("removes a pidfile of a nats that is no longer running", func() {
+			Expect(os.WriteFile(pidFile, []byte("999999999\n"), 0644)).To(Succeed())
+
+			StartServer(cfg)
+
+			Eventually(readOutput).Should(Equal("v2\n"))
+			Eventually(readPid).ShouldNot(Equal(999999999))
+			Expect(string(session.Out.Contents())).NotTo(ContainSubstring("terminating-orphaned-nats"))
+		})
+
+		Context("when the orphan policy is refuse", func() {
+			BeforeEach(func() {
+				cfg.NATSOrphanPolicy = "refuse"
+			})
+
+			It("exits with an error instead of starting nats", func() {
+				pid := startOrphan()
+
+				StartServerWithoutWaiting(cfg)
+
+				Eventually(session, 10).Should(gexec.Exit(2))
+				Expect(session.Out).To(gbytes.Say(fmt.Sprintf(`nats %s from a previous wrapper is still running with pid %d, stop it before starting the wrapper`, natsV2File, pid)))
+				Expect(natsRunning(pid)).To(BeTrue())
+				Expect(readOutput()).To(Equal("v2\n"))
+			})
+		})
+	})
+
+	Describe("embedded mode", func() {
+		var natsConfigFile string
+
+		getStatus := func() map[string]interface{} {
+			resp, err := client.Get(fmt.Sprintf("https://%s/status", address))
+			Expect(err).ToNot(HaveOccurred())
+			defer resp.Body.Close()
+			var status map[string]interface{}
+			Expect(json.NewDecoder(resp.Body).Decode(&status)).To(Succeed())
+			return status
+		}
+
+		connect := func() error {
+			conn, err := nats.Connect(fmt.Sprintf("nats://127.0.0.1:%d", natsPort))
+			if err != nil {
+				return err
+			}
+			conn.Close()
+			return nil
+		}
+
+		BeforeEach(func() {
+			file, err := os.CreateTemp("", "nats-conf-")
+			Expect(err).NotTo(HaveOccurred())
+			natsConfigFile = file.Name()
+			Expect(os.WriteFile(natsConfigFile, []byte(fmt.Sprintf("port: %d\n", natsPort)), 0644)).To(Succeed())
+
+			cfg = config.Config{
+				Bootstrap:            true,
+				NATSMigratePort:      int(natsMigratorPort),
+				Address:              "127.0.0.1",
+				NATSPort:             int(natsPort),
+				NATSInstances:        []string{fmt.Sprintf("127.0.0.1:%d", natsPort)},
+				NATSV1BinPath:        natsV1File,
+				NATSV2BinPath:        natsV2File,
+				NATSConfigPath:       natsConfigFile,
+				NATSEmbedded:         true,
+				NATSReadinessTimeout: config.Duration(5 * time.Second),
+			}
+			GenerateCerts(&cfg)
+		})
+
+		AfterEach(func() {
+			os.Remove(natsConfigFile)
+		})
+
+		Context("when v2 is the starting binary", func() {
+			BeforeEach(func() {
+				StartServer(cfg)
+				client = CreateTLSClient(cfg)
+			})
+
+			It("runs nats-server in the wrapper process", func() {
+				Eventually(session.Out).Should(gbytes.Say(`embedding-nats.*"binary":"v2"`))
+				Eventually(connect).Should(Succeed())
+
+				status := getStatus()
+				Expect(status["binary"]).To(Equal("v2"))
+				Expect(status["embedded"]).To(BeTrue())
+				Expect(status["pid"]).To(BeEquivalentTo(session.Command.Process.Pid))
+				Expect(status["running"]).To(BeTrue())
+
+				_, err := os.Stat(outputFile)
+				Expect(os.IsNotExist(err)).To(BeTrue(), "the v2 binary should not have been started")
+			})
+
+			It("reloads the config when it receives SIGHUP", func() {
+				Eventually(connect).Should(Succeed())
+				Expect(os.WriteFile(natsConfigFile, []byte(fmt.Sprintf("port: %d\nmax_payload: 2048\n", natsPort)), 0644)).To(Succeed())
+
+				session.Signal(syscall.SIGHUP)
+				Eventually(session.Out).Should(gbytes.Say(`"source":"nats","message":"nats.output".*"msg":"Reloaded server configuration","nats_level":"INF"`))
+				Consistently(session, "500ms").ShouldNot(gexec.Exit())
+			})
+
+			It("shuts the server down when it is stopped", func() {
+				Eventually(connect).Should(Succeed())
+
+				session.Terminate()
+				Eventually(session, 5*time.Second).Should(gexec.Exit(0))
+				Expect(connect()).NotTo(Succeed())
+			})
+		})
+
+		Context("when the wrapper uses more memory than the restart limit", func() {
+			BeforeEach(func() {
+				cfg.NATSMemLimitRestart = "1 KB"
+				cfg.NATSMemCheckInterval = config.Duration(100 * time.Millisecond)
+				StartServer(cfg)
+				client = CreateTLSClient(cfg)
+			})
+
+			It("restarts the embedded server on every start that goes above the limit", func() {
+				Eventually(session.Out).Should(gbytes.Say(`memory-above-restart-limit.*"embedded":true`))
+				Eventually(session.Out).Should(gbytes.Say("restarted-nats"))
+				Eventually(session.Out).Should(gbytes.Say(`memory-above-restart-limit.*"embedded":true`))
+				Eventually(session.Out).Should(gbytes.Say("restarted-nats"))
+
+				Eventually(connect).Should(Succeed())
+				Expect(getStatus()["restarts"]).To(BeNumerically(">=", 2))
+				Expect(session).NotTo(gexec.Exit())
+			})
+		})
+
+		Context("when the node starts on v1", func() {
+			var pidFile string
+
+			BeforeEach(func() {
+				file, err := os.CreateTemp("", "nats-pid-")
+				Expect(err).NotTo(HaveOccurred())
+				pidFile = file.Name()
+
+				helpers.MockNATS{
+					Version:      "v1",
+					OutputFile:   outputFile,
+					AppendOutput: true,
+					PidFile:      pidFile,
+					Exec:         helpers.Build("github.com/nats-io/gnatsd"),
+				}.Write(natsV1File)
+				cfg.NATSBinaryOverride = "v1"
+				StartServer(cfg)
+				client = CreateTLSClient(cfg)
+			})
+
+			AfterEach(func() {
+				// gnatsd outlives the killed wrapper
+				content, err := os.ReadFile(pidFile)
+				if err == nil && len(content) > 0 {
+					pid, err := strconv.Atoi(strings.TrimSpace(string(content)))
+					Expect(err).NotTo(HaveOccurred())
+					if process, err := os.FindProcess(pid); err == nil {
+						process.Kill()
+					}
+				}
+				os.Remove(pidFile)
+			})
+
+			It("migrates to the embedded server and rolls back to the v1 binary", func() {
+				Eventually(connect).Should(Succeed())
+				Expect(getStatus()["embedded"]).To(BeFalse())
+
+				resp, err := client.Post(fmt.Sprintf("https://%s/migrate", address), "application/json", nil)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				Eventually(session.Out).Should(gbytes.Say("nats-is-ready"))
+				Expect(connect()).To(Succeed())
+
+				status := getStatus()
+				Expect(status["binary"]).To(Equal("v2"))
+				Expect(status["embedded"]).To(BeTrue())
+				Expect(status["migration"]).To(Equal("migrated"))
+
+				resp, err = client.Post(fmt.Sprintf("https://%s/rollback", address), "application/json", nil)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				Expect(connect()).To(Succeed())
+
+				status = getStatus()
+				Expect(status["binary"]).To(Equal("v1"))
+				Expect(status["embedded"]).To(BeFalse())
+
+				content, err := os.ReadFile(outputFile)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(content)).To(Equal("v1\nv1\n"))
+			})
+		})
+	})
+
+	Describe("lame duck mode", func() {
+		var (
+			natsRunner1  *helpers.NATSRunner
+			lameDuckFile string
+		)
+
+		BeforeEach(func() {
+			file, err := os.CreateTemp("", "lame-duck-file-")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(os.Remove(file.Name())).To(Succeed())
+			lameDuckFile = file.Name()
+
+			helpers.MockNATS{
+				Version:    "v1",
+				OutputFile: outputFile,
+				Traps:      map[string]string{"USR2": "echo v1 >" + lameDuckFile + "; " + helpers.ExitOnSignal},
+			}.Write(natsV1File)
+			helpers.MockNATS{
+				Version:    "v2",
+				OutputFile: outputFile,
+				Traps:      map[string]string{"USR2": "echo v2 >" + lameDuckFile + "; " + helpers.ExitOnSignal},
+			}.Write(natsV2File)
+
+			natsRunner1 = helpers.NewNATSRunner(int(natsRunnerPort1))
+			natsRunner1.StartV1()
+
+			cfg = config.Config{
+				Bootstrap:       true,
+				NATSMigratePort: int(natsMigratorPort),
+				Address:         "127.0.0.1",
+				NATSPort:        int(natsPort),
+				NATSInstances: []string{
+					fmt.Sprintf("127.0.0.1:%d", natsPort),
+					natsRunner1.Addr(),
+				},
+				NATSMigrateServers: []string{
+					fmt.Sprintf("127.0.0.1:%d", natsMigratorPort),
+					natsRunner1.URL(),
+				},
+				NATSV1BinPath:           natsV1File,
+				NATSV2BinPath:           natsV2File,
+				NATSLameDuckDuration:    config.Duration(5 * time.Second),
+				NATSLameDuckGracePeriod: config.Duration(time.Second),
+			}
+			GenerateCerts(&cfg)
+		})
+
+		JustBeforeEach(func() {
+			StartServer(cfg)
+			client = CreateTLSClient(cfg)
+		})
+
+		AfterEach(func() {
+			natsRunner1.Stop()
+			os.Remove(lameDuckFile)
+		})
+
+		It("puts v1 into lame duck mode before starting v2", func() {
+			resp, err := client.Post(fmt.Sprintf("https://%s/migrate", address), "application/json", nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(200))
+
+			content, err := os.ReadFile(lameDuckFile)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(content)).To(ContainSubstring("v1"))
+
+			Eventually(func() string {
+				content, err := os.ReadFile(outputFile)
+				Expect(err).ToNot(HaveOccurred())
+				return string(content)
+			}).Should(ContainSubstring("v2"))
+			Eventually(session.Out).Should(gbytes.Say("finished-lame-duck-mode"))
+		})
+
+		It("puts nats into lame duck mode when it is stopped", func() {
+			session.Terminate()
+			Eventually(session, 10*time.Second).Should(gexec.Exit(0))
+
+			content, err := os.ReadFile(lameDuckFile)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(content)).To(ContainSubstring("v1"))
+		})
+
+		Context("when lame duck mode would outlast the bpm shutdown timeout", func() {
+			BeforeEach(func() {
+				helpers.MockNATS{
+					Version:    "v1",
+					OutputFile: outputFile,
+					Traps:      map[string]string{"USR2": ""},
+				}.Write(natsV1File)
+				cfg.NATSLameDuckDuration = config.Duration(30 * time.Second)
+				cfg.NATSLameDuckGracePeriod = config.Duration(5 * time.Second)
+			})
+
+			It("stops nats before bpm kills the job", func() {
+				start := time.Now()
+				session.Terminate()
+				Eventually(session, 25*time.Second).Should(gexec.Exit(0))
+				Expect(time.Since(start)).To(BeNumerically("<", 20*time.Second))
+				Expect(session.Out).To(gbytes.Say(`entering-lame-duck-mode.*"timeout":"14s"`))
+				Expect(session.Out).To(gbytes.Say("lame-duck-mode-timed-out"))
 			})
 		})
 	})
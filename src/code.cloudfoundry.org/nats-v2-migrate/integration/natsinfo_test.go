@@ -0,0 +1,507 @@
+package integration
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"code.cloudfoundry.org/cf-networking-helpers/certauthority"
+	"code.cloudfoundry.org/cf-networking-helpers/portauthority"
+	"code.cloudfoundry.org/nats-v2-migrate/integration/helpers"
+	"code.cloudfoundry.org/nats-v2-migrate/natsinfo"
+	"code.cloudfoundry.org/tlsconfig"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("natsinfo", func() {
+	var natsRunner *helpers.NATSRunner
+
+	BeforeEach(func() {
+		node := GinkgoParallelProcess()
+		startPort := 1000 * node
+		portRange := 950
+		endPort := startPort + portRange
+
+		allocator, err := portauthority.New(startPort, endPort)
+		Expect(err).NotTo(HaveOccurred())
+		port, err := allocator.ClaimPorts(1)
+		Expect(err).NotTo(HaveOccurred())
+
+		natsRunner = helpers.NewNATSRunner(int(port))
+	})
+
+	AfterEach(func() {
+		natsRunner.Stop()
+	})
+
+	Describe("GetServerInfo", func() {
+		Context("when the server is running v2", func() {
+			BeforeEach(func() {
+				natsRunner.Start()
+			})
+
+			It("returns the parsed INFO block", func() {
+				info, err := natsinfo.GetServerInfo(natsRunner.Addr())
+				Expect(err).NotTo(HaveOccurred())
+				Expect(info.ServerID).NotTo(BeEmpty())
+				Expect(info.SemVer.Major).To(Equal(2))
+				Expect(info.SemVer.String()).To(HavePrefix("2.10."))
+				Expect(info.Proto).To(BeNumerically(">=", 1))
+				Expect(info.GoVersion).To(HavePrefix("go"))
+				Expect(info.MaxPayload).To(BeNumerically(">", 0))
+				Expect(info.TLSRequired).To(BeFalse())
+				Expect(info.AuthRequired).To(BeFalse())
+			})
+		})
+
+		Context("when the server is running v1", func() {
+			BeforeEach(func() {
+				natsRunner.StartV1()
+			})
+
+			It("returns the parsed INFO block", func() {
+				info, err := natsinfo.GetServerInfo(natsRunner.Addr())
+				Expect(err).NotTo(HaveOccurred())
+				Expect(info.ServerID).NotTo(BeEmpty())
+				Expect(info.Version).To(Equal("1.4.1"))
+				Expect(info.SemVer).To(Equal(natsinfo.SemVer{Major: 1, Minor: 4, Patch: 1}))
+			})
+		})
+	})
+
+	Describe("Ping", func() {
+		Context("when the server requires TLS and credentials", func() {
+			var (
+				certDepoDir string
+				tlsConfig   *tls.Config
+			)
+
+			BeforeEach(func() {
+				var err error
+				certDepoDir, err = os.MkdirTemp("", "cert-depot-dir-")
+				Expect(err).NotTo(HaveOccurred())
+
+				ca, err := certauthority.NewCertAuthority(certDepoDir, "natsinfo-ca")
+				Expect(err).NotTo(HaveOccurred())
+				keyFile, certFile, err := ca.GenerateSelfSignedCertAndKey("server", []string{}, false)
+				Expect(err).NotTo(HaveOccurred())
+				_, caFile := ca.CAAndKey()
+
+				natsRunner.StartWithArgs(
+					"--tls", "--tlsverify",
+					"--tlscert", certFile, "--tlskey", keyFile, "--tlscacert", caFile,
+					"--user", "nats", "--pass", "secret",
+				)
+
+				tlsConfig, err = tlsconfig.Build(
+					tlsconfig.WithInternalServiceDefaults(),
+					tlsconfig.WithIdentityFromFile(certFile, keyFile),
+				).Client(tlsconfig.WithAuthorityFromFile(caFile))
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			AfterEach(func() {
+				Expect(os.RemoveAll(certDepoDir)).To(Succeed())
+			})
+
+			It("reads INFO without TLS", func() {
+				info, err := natsinfo.GetServerInfo(natsRunner.Addr())
+				Expect(err).NotTo(HaveOccurred())
+				Expect(info.TLSRequired).To(BeTrue())
+				Expect(info.AuthRequired).To(BeTrue())
+			})
+
+			It("upgrades the connection and gets a PONG", func() {
+				info, err := natsinfo.Ping(natsRunner.Addr(), natsinfo.ProbeOptions{
+					TLSConfig: tlsConfig,
+					User:      "nats",
+					Password:  "secret",
+				})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(info.SemVer.Major).To(Equal(2))
+			})
+
+			It("fails without a TLS config", func() {
+				_, err := natsinfo.Ping(natsRunner.Addr(), natsinfo.ProbeOptions{User: "nats", Password: "secret"})
+				Expect(err).To(MatchError(natsinfo.ErrTLSRequired))
+			})
+
+			It("fails with the wrong credentials", func() {
+				_, err := natsinfo.Ping(natsRunner.Addr(), natsinfo.ProbeOptions{
+					TLSConfig: tlsConfig,
+					User:      "nats",
+					Password:  "wrong",
+				})
+				Expect(err).To(MatchError(ContainSubstring("Authorization Violation")))
+			})
+		})
+	})
+
+	Describe("Prober", func() {
+		var prober *natsinfo.Prober
+
+		BeforeEach(func() {
+			prober = natsinfo.NewProber()
+			prober.RetryInterval = 100 * time.Millisecond
+			prober.MaxRetryInterval = 400 * time.Millisecond
+			prober.Jitter = 0.5
+		})
+
+		It("retries until the server comes up", func() {
+			go func() {
+				defer GinkgoRecover()
+				time.Sleep(500 * time.Millisecond)
+				natsRunner.Start()
+			}()
+
+			version, err := prober.GetMajorVersion(context.Background(), natsRunner.Addr())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(version).To(Equal(2))
+		})
+
+		It("gives up once the deadline has passed", func() {
+			prober.Deadline = time.Second
+
+			start := time.Now()
+			_, err := prober.GetServerInfo(context.Background(), natsRunner.Addr())
+			Expect(err).To(BeAssignableToTypeOf(&natsinfo.ErrConnectingToNATS{}))
+			Expect(err).To(MatchError(ContainSubstring("deadline exceeded")))
+			Expect(time.Since(start)).To(BeNumerically("<", 2*time.Second))
+		})
+
+		Context("with a zero value Prober", func() {
+			BeforeEach(func() {
+				prober = &natsinfo.Prober{}
+			})
+
+			It("probes a running server once", func() {
+				natsRunner.Start()
+
+				info, err := prober.GetServerInfo(context.Background(), natsRunner.Addr())
+				Expect(err).NotTo(HaveOccurred())
+				Expect(info.SemVer.Major).To(Equal(2))
+			})
+
+			It("fails after one attempt when nothing listens", func() {
+				start := time.Now()
+				_, err := prober.GetServerInfo(context.Background(), natsRunner.Addr())
+				Expect(err).To(BeAssignableToTypeOf(&natsinfo.ErrConnectingToNATS{}))
+				Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+			})
+		})
+
+		It("gives up when the context is cancelled", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(500*time.Millisecond, cancel)
+
+			start := time.Now()
+			_, err := prober.GetServerInfo(ctx, natsRunner.Addr())
+			Expect(err).To(MatchError(ContainSubstring("context canceled")))
+			Expect(time.Since(start)).To(BeNumerically("<", 2*time.Second))
+		})
+	})
+
+	Describe("monitoring port fallback", func() {
+		var (
+			prober          *natsinfo.Prober
+			saturatedPort   uint16
+			saturatedListen net.Listener
+		)
+
+		BeforeEach(func() {
+			node := GinkgoParallelProcess()
+			allocator, err := portauthority.New(1000*node+950, 1000*node+999)
+			Expect(err).NotTo(HaveOccurred())
+			monitorPort, err := allocator.ClaimPorts(1)
+			Expect(err).NotTo(HaveOccurred())
+			saturatedPort, err = allocator.ClaimPorts(1)
+			Expect(err).NotTo(HaveOccurred())
+
+			natsRunner.StartWithArgs("-m", strconv.Itoa(int(monitorPort)))
+
+			// accepts connections but never sends INFO, like a flooded client port
+			saturatedListen, err = net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", saturatedPort))
+			Expect(err).NotTo(HaveOccurred())
+			go func() {
+				for {
+					_, err := saturatedListen.Accept()
+					if err != nil {
+						return
+					}
+				}
+			}()
+
+			prober = natsinfo.NewProber()
+			prober.Timeout = 500 * time.Millisecond
+			prober.MonitorPort = int(monitorPort)
+		})
+
+		AfterEach(func() {
+			saturatedListen.Close()
+		})
+
+		It("reads the client port when it answers", func() {
+			info, err := prober.GetServerInfo(context.Background(), natsRunner.Addr())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info.Source).To(Equal(natsinfo.SourceClient))
+		})
+
+		It("falls back to /varz when the client port does not answer", func() {
+			info, err := prober.GetServerInfo(context.Background(), fmt.Sprintf("127.0.0.1:%d", saturatedPort))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info.Source).To(Equal(natsinfo.SourceMonitor))
+			Expect(info.SemVer.Major).To(Equal(2))
+			Expect(info.ServerID).NotTo(BeEmpty())
+			Expect(info.Uptime).NotTo(BeEmpty())
+		})
+
+		It("returns both errors when the fallback fails too", func() {
+			natsRunner.Stop()
+
+			_, err := prober.GetServerInfo(context.Background(), fmt.Sprintf("127.0.0.1:%d", saturatedPort))
+			Expect(err).To(MatchError(ContainSubstring("Error reading")))
+			Expect(err).To(MatchError(ContainSubstring("falling back to the monitoring port")))
+		})
+
+		It("does not fall back once the deadline has passed", func() {
+			// the monitoring port hangs like the client port
+			prober.MonitorPort = int(saturatedPort)
+			prober.Timeout = 2 * time.Second
+			prober.Deadline = time.Second
+
+			start := time.Now()
+			_, err := prober.GetServerInfo(context.Background(), fmt.Sprintf("127.0.0.1:%d", saturatedPort))
+			Expect(err).To(HaveOccurred())
+			Expect(err).NotTo(MatchError(ContainSubstring("falling back to the monitoring port")))
+			Expect(time.Since(start)).To(BeNumerically("<", 1500*time.Millisecond))
+		})
+
+		It("bounds the fallback by the rest of the deadline", func() {
+			prober.MonitorPort = int(saturatedPort)
+			prober.Timeout = 500 * time.Millisecond
+			prober.Deadline = 800 * time.Millisecond
+
+			start := time.Now()
+			_, err := prober.GetServerInfo(context.Background(), fmt.Sprintf("127.0.0.1:%d", saturatedPort))
+			Expect(err).To(MatchError(ContainSubstring("falling back to the monitoring port")))
+			Expect(time.Since(start)).To(BeNumerically("<", 950*time.Millisecond))
+		})
+	})
+
+	Describe("Survey", func() {
+		var v1Runner, unreachableRunner *helpers.NATSRunner
+
+		BeforeEach(func() {
+			node := GinkgoParallelProcess()
+			allocator, err := portauthority.New(1000*node+950, 1000*node+999)
+			Expect(err).NotTo(HaveOccurred())
+			v1Port, err := allocator.ClaimPorts(1)
+			Expect(err).NotTo(HaveOccurred())
+			unreachablePort, err := allocator.ClaimPorts(1)
+			Expect(err).NotTo(HaveOccurred())
+
+			v1Runner = helpers.NewNATSRunner(int(v1Port))
+			unreachableRunner = helpers.NewNATSRunner(int(unreachablePort))
+
+			natsRunner.Start()
+			v1Runner.StartV1()
+		})
+
+		AfterEach(func() {
+			v1Runner.Stop()
+		})
+
+		It("reports every instance in order", func() {
+			prober := natsinfo.NewProber()
+			prober.Retries = 1
+
+			results := prober.Survey(context.Background(), []string{natsRunner.Addr(), unreachableRunner.Addr(), v1Runner.Addr()}, 2)
+			Expect(results).To(HaveLen(3))
+
+			Expect(results[0].Instance).To(Equal(natsRunner.Addr()))
+			Expect(results[0].Reachable).To(BeTrue())
+			Expect(results[0].Version).To(HavePrefix("2."))
+			Expect(results[0].ErrorClass).To(Equal(natsinfo.ErrorClassNone))
+
+			Expect(results[1].Instance).To(Equal(unreachableRunner.Addr()))
+			Expect(results[1].Reachable).To(BeFalse())
+			Expect(results[1].ErrorClass).To(Equal(natsinfo.ErrorClassUnreachable))
+			Expect(results[1].Error).To(ContainSubstring("connection refused"))
+
+			Expect(results[2].Instance).To(Equal(v1Runner.Addr()))
+			Expect(results[2].Version).To(Equal("1.4.1"))
+			Expect(results[2].Latency).To(BeNumerically(">", 0))
+
+			Expect(natsinfo.IsMixedVersion(results)).To(BeTrue())
+			Expect(natsinfo.IsMixedVersion(results[:2])).To(BeFalse())
+		})
+	})
+
+	Describe("GetRouteInfo", func() {
+		var clusterPort, unusedPort uint16
+
+		BeforeEach(func() {
+			node := GinkgoParallelProcess()
+			allocator, err := portauthority.New(1000*node+950, 1000*node+999)
+			Expect(err).NotTo(HaveOccurred())
+			clusterPort, err = allocator.ClaimPorts(1)
+			Expect(err).NotTo(HaveOccurred())
+			unusedPort, err = allocator.ClaimPorts(1)
+			Expect(err).NotTo(HaveOccurred())
+
+			natsRunner.StartWithArgs("--cluster", fmt.Sprintf("nats://127.0.0.1:%d", clusterPort), "--cluster_name", "test-cluster")
+		})
+
+		It("returns the route INFO of the same server", func() {
+			prober := natsinfo.NewProber()
+			clientInfo, err := prober.GetServerInfo(context.Background(), natsRunner.Addr())
+			Expect(err).NotTo(HaveOccurred())
+
+			routeInfo, err := prober.GetRouteInfo(context.Background(), fmt.Sprintf("127.0.0.1:%d", clusterPort))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(routeInfo.ServerID).To(Equal(clientInfo.ServerID))
+			Expect(routeInfo.Cluster).To(Equal("test-cluster"))
+			Expect(routeInfo.Port).To(Equal(int(clusterPort)))
+			Expect(routeInfo.TLSRequired).To(BeFalse())
+		})
+
+		It("fails when nothing listens on the cluster port", func() {
+			prober := natsinfo.NewProber()
+			prober.Retries = 1
+
+			_, err := prober.GetRouteInfo(context.Background(), fmt.Sprintf("127.0.0.1:%d", unusedPort))
+			var connectErr *natsinfo.ErrConnectingToNATS
+			Expect(errors.As(err, &connectErr)).To(BeTrue())
+		})
+	})
+
+	Describe("GetRouteInfo with a TLS route listener", func() {
+		var (
+			clusterPort uint16
+			certDir     string
+			tlsConfig   *tls.Config
+		)
+
+		BeforeEach(func() {
+			node := GinkgoParallelProcess()
+			allocator, err := portauthority.New(1000*node+950, 1000*node+999)
+			Expect(err).NotTo(HaveOccurred())
+			clusterPort, err = allocator.ClaimPorts(1)
+			Expect(err).NotTo(HaveOccurred())
+
+			certDir, err = os.MkdirTemp("", "route-tls-")
+			Expect(err).NotTo(HaveOccurred())
+			caFile, certFile, keyFile := helpers.ServerCerts(certDir)
+
+			natsConfigFile := filepath.Join(certDir, "nats.conf")
+			natsConfig := fmt.Sprintf(`cluster {
+  name: test-cluster
+  listen: "127.0.0.1:%d"
+  tls {
+    ca_file: %q
+    cert_file: %q
+    key_file: %q
+    verify: true
+  }
+}
+`, clusterPort, caFile, certFile, keyFile)
+			Expect(os.WriteFile(natsConfigFile, []byte(natsConfig), 0644)).To(Succeed())
+			natsRunner.StartWithArgs("-c", natsConfigFile)
+
+			tlsConfig, err = tlsconfig.Build(
+				tlsconfig.WithInternalServiceDefaults(),
+				tlsconfig.WithIdentityFromFile(certFile, keyFile),
+			).Client(tlsconfig.WithAuthorityFromFile(caFile))
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(certDir)).To(Succeed())
+		})
+
+		It("reads the route INFO after the TLS handshake", func() {
+			prober := natsinfo.NewProber()
+			prober.RouteTLSConfig = tlsConfig
+
+			routeInfo, err := prober.GetRouteInfo(context.Background(), fmt.Sprintf("127.0.0.1:%d", clusterPort))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(routeInfo.Cluster).To(Equal("test-cluster"))
+			Expect(routeInfo.TLSRequired).To(BeTrue())
+		})
+
+		It("times out without a route TLS config", func() {
+			prober := natsinfo.NewProber()
+			prober.Retries = 1
+			prober.Timeout = 500 * time.Millisecond
+
+			_, err := prober.GetRouteInfo(context.Background(), fmt.Sprintf("127.0.0.1:%d", clusterPort))
+			Expect(err).To(MatchError(ContainSubstring("timeout")))
+		})
+	})
+
+	Describe("ParseSemVer", func() {
+		It("parses pre-release and build metadata", func() {
+			version, err := natsinfo.ParseSemVer("2.10.22-beta.1+build")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(version).To(Equal(natsinfo.SemVer{Major: 2, Minor: 10, Patch: 22, PreRelease: []string{"beta", "1"}, Build: "build"}))
+			Expect(version.String()).To(Equal("2.10.22-beta.1+build"))
+		})
+
+		It("orders versions by precedence", func() {
+			ordered := []string{"1.0.0-alpha", "1.0.0-alpha.1", "1.0.0-alpha.beta", "1.0.0-beta", "1.0.0-beta.2", "1.0.0-beta.11", "1.0.0-rc.1", "1.0.0", "1.4.1", "2.9.25", "2.10.0", "2.10.22"}
+			for i := 1; i < len(ordered); i++ {
+				lower, err := natsinfo.ParseSemVer(ordered[i-1])
+				Expect(err).NotTo(HaveOccurred())
+				higher, err := natsinfo.ParseSemVer(ordered[i])
+				Expect(err).NotTo(HaveOccurred())
+				Expect(lower.LessThan(higher)).To(BeTrue(), "%s < %s", lower, higher)
+				Expect(higher.Compare(lower)).To(Equal(1))
+			}
+
+			a, _ := natsinfo.ParseSemVer("2.10.22+a")
+			b, _ := natsinfo.ParseSemVer("2.10.22+b")
+			Expect(a.Equal(b)).To(BeTrue())
+		})
+
+		It("rejects versions that are not semantic versions", func() {
+			_, err := natsinfo.ParseSemVer("2.10")
+			Expect(err).To(HaveOccurred())
+			_, err = natsinfo.ParseSemVer("2.x.1")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	DescribeTable("ParseConstraint",
+		func(constraint, version string, satisfied bool) {
+			c, err := natsinfo.ParseConstraint(constraint)
+			Expect(err).NotTo(HaveOccurred())
+			v, err := natsinfo.ParseSemVer(version)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(c.Check(v)).To(Equal(satisfied))
+		},
+		Entry(nil, ">=2.10.0 <3", "2.10.22", true),
+		Entry(nil, ">=2.10.0 <3", "2.9.25", false),
+		Entry(nil, ">=2.10.0 <3", "3.0.0", false),
+		Entry(nil, ">=2.10.22", "2.10.22-beta.1", false),
+		Entry(nil, "<2", "1.4.1", true),
+		Entry(nil, "2.10.22", "2.10.22", true),
+		Entry(nil, "!=2.10.21", "2.10.21", false),
+		Entry(nil, "<2 || >=2.10", "2.9.0", false),
+		Entry(nil, "<2 || >=2.10", "2.11.0", true),
+	)
+
+	It("rejects invalid constraints", func() {
+		_, err := natsinfo.ParseConstraint(">=two")
+		Expect(err).To(HaveOccurred())
+		_, err = natsinfo.ParseConstraint("<2 ||")
+		Expect(err).To(HaveOccurred())
+	})
+})
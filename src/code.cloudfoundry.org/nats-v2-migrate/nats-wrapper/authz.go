@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/x509"
+	"errors"
+	"net/http"
+
+	"code.cloudfoundry.org/lager/v3"
+)
+
+const AllEndpoints = "*"
+
+// ClientAllowlist maps migrate server paths to the client certificate
+// identities that may call them. An identity is a subject common name, a DNS,
+// IP or email SAN, or a URI SAN such as a SPIFFE ID. The AllEndpoints entry
+// applies to paths without their own entry, and paths without either entry
+// are closed. An empty allowlist lets every client the CA trusts call every
+// path.
+type ClientAllowlist map[string][]string
+
+// Allows reports whether a client with any of identities may call path.
+func (a ClientAllowlist) Allows(path string, identities []string) bool {
+	if len(a) == 0 {
+		return true
+	}
+
+	allowed, ok := a[path]
+	if !ok {
+		allowed = a[AllEndpoints]
+	}
+	for _, entry := range allowed {
+		for _, identity := range identities {
+			if entry == identity {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// authorizeClients rejects requests whose client certificate is not in the
+// allowlist for the path with 403, and logs them as audit events.
+func authorizeClients(logger lager.Logger, allowlist ClientAllowlist, next http.Handler) http.Handler {
+	logger = logger.Session("audit")
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var identities []string
+		if req.TLS != nil && len(req.TLS.PeerCertificates) > 0 {
+			identities = certificateIdentities(req.TLS.PeerCertificates[0])
+		}
+
+		if !allowlist.Allows(req.URL.Path, identities) {
+			logger.Error("rejected-unauthorized-client", errors.New("client certificate is not in the allowlist for this endpoint"), lager.Data{
+				"method":      req.Method,
+				"path":        req.URL.Path,
+				"remote_addr": req.RemoteAddr,
+				"identities":  identities,
+			})
+			w.WriteHeader(http.StatusForbidden)
+			// #nosec G104 - don't handle error writing http response. at best, we could log it and be susceptible to DoS's filling up disks with logs
+			w.Write(nil)
+			return
+		}
+
+		next.ServeHTTP(w, req)
+	})
+}
+
+// certificateIdentities lists the identities a client certificate can be
+// allowed by, starting with the common name.
+func certificateIdentities(cert *x509.Certificate) []string {
+	var identities []string
+	if cert.Subject.CommonName != "" {
+		identities = append(identities, cert.Subject.CommonName)
+	}
+	identities = append(identities, cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		identities = append(identities, ip.String())
+	}
+	identities = append(identities, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		identities = append(identities, uri.String())
+	}
+	return identities
+}
+
+// clientIdentity names the client certificate of req by its first identity.
+func clientIdentity(req *http.Request) string {
+	if req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
+		return ""
+	}
+
+	identities := certificateIdentities(req.TLS.PeerCertificates[0])
+	if len(identities) == 0 {
+		return ""
+	}
+	return identities[0]
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+
+	"code.cloudfoundry.org/nats-v2-migrate/config"
+	"code.cloudfoundry.org/nats-v2-migrate/natsinfo"
+	"github.com/nats-io/nats-server/v2/server"
+)
+
+// EmbeddedNATSVersion is the version of the vendored nats-server that runs in
+// the wrapper process in embedded mode.
+var EmbeddedNATSVersion = server.VERSION
+
+// EmbeddedNATS runs the vendored nats-server inside the wrapper process with
+// the same config file the nats-server binary would read. Signals are
+// translated into calls on the server instead of being sent to a child.
+// nats-server exits the process on fatal errors such as a port that is in
+// use, so those end the wrapper like a crash of the binary would.
+type EmbeddedNATS struct {
+	server     *server.Server
+	exited     chan struct{}
+	configPath string
+	output     *natsLog
+}
+
+// embeddedBinary returns the name of the binary whose version constraint the
+// embedded nats-server satisfies.
+func embeddedBinary(binaries config.NATSBinaries) (string, error) {
+	version, err := natsinfo.ParseSemVer(EmbeddedNATSVersion)
+	if err != nil {
+		return "", err
+	}
+	binary, ok := binaries.ForVersion(version)
+	if !ok {
+		return "", fmt.Errorf("no nats binary matches the embedded nats-server %s", EmbeddedNATSVersion)
+	}
+	return binaries[binary].Name, nil
+}
+
+// NewEmbeddedNATS starts the server. Its log statements go to output when it
+// is set, unless the config sends them to a file or syslog.
+func NewEmbeddedNATS(configPath string, output *natsLog) (*EmbeddedNATS, error) {
+	opts, err := server.ProcessConfigFile(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("reading nats config %s: %w", configPath, err)
+	}
+	// the wrapper forwards signals itself
+	opts.NoSigs = true
+
+	s, err := server.NewServer(opts)
+	if err != nil {
+		return nil, err
+	}
+	embedded := &EmbeddedNATS{server: s, exited: make(chan struct{}), configPath: configPath, output: output}
+	embedded.configureLogger(opts)
+	s.Start()
+
+	go func() {
+		s.WaitForShutdown()
+		close(embedded.exited)
+	}()
+
+	return embedded, nil
+}
+
+func (e *EmbeddedNATS) configureLogger(opts *server.Options) {
+	if e.output == nil || opts.LogFile != "" || opts.Syslog || opts.RemoteSyslog != "" {
+		e.server.ConfigureLogger()
+		return
+	}
+	e.server.SetLoggerV2(embeddedLogger{log: e.output}, opts.Debug, opts.Trace, opts.TraceVerbose)
+}
+
+func (e *EmbeddedNATS) Exited() <-chan struct{} {
+	return e.exited
+}
+
+// ExitCode is always 0, an embedded server does not crash without taking the
+// wrapper down with it.
+func (e *EmbeddedNATS) ExitCode() int {
+	return 0
+}
+
+func (e *EmbeddedNATS) PID() int {
+	return os.Getpid()
+}
+
+// Signal does what nats-server does when it receives signal. Stopping
+// signals wait for the server to shut down.
+func (e *EmbeddedNATS) Signal(signal os.Signal) {
+	switch signal {
+	case syscall.SIGHUP:
+		err := e.Reload()
+		if err != nil {
+			e.server.Errorf("Failed to reload server configuration: %s", err)
+		}
+	case syscall.SIGUSR1:
+		e.server.ReOpenLogFile()
+	case syscall.SIGUSR2:
+		go e.server.LameDuckShutdown()
+	case os.Interrupt, syscall.SIGTERM, os.Kill:
+		e.Shutdown()
+	}
+}
+
+// Reload re-reads the config file and applies the options that can change
+// while the server runs. nats-server replaces the logger when the logging
+// options change, so it is configured again.
+func (e *EmbeddedNATS) Reload() error {
+	err := e.server.Reload()
+	if err != nil {
+		return err
+	}
+
+	opts, err := server.ProcessConfigFile(e.configPath)
+	if err != nil {
+		return err
+	}
+	e.configureLogger(opts)
+	return nil
+}
+
+func (e *EmbeddedNATS) Shutdown() {
+	e.server.Shutdown()
+	e.server.WaitForShutdown()
+}
+
+// LameDuckShutdown puts the server into lame duck mode and waits up to
+// timeout for it to shut down. It shuts the server down when it is still
+// running after timeout and reports whether it drained.
+func (e *EmbeddedNATS) LameDuckShutdown(timeout time.Duration) bool {
+	go e.server.LameDuckShutdown()
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case <-e.exited:
+		return true
+	case <-t.C:
+		e.Shutdown()
+		return false
+	}
+}
+
+// StderrLines returns nothing, the server logs through the wrapper.
+func (e *EmbeddedNATS) StderrLines() []string {
+	return nil
+}
+
+// checkReady asks the server whether it accepts clients, waiting up to wait,
+// and whether it has routes to expectedRoutes peers.
+func (e *EmbeddedNATS) checkReady(wait time.Duration, expectedRoutes int) error {
+	if !e.server.ReadyForConnections(wait) {
+		return errors.New("embedded nats is not accepting connections")
+	}
+	if expectedRoutes == 0 {
+		return nil
+	}
+
+	routez, err := e.server.Routez(nil)
+	if err != nil {
+		return err
+	}
+	peers := natsinfo.Routez{NumRoutes: routez.NumRoutes}
+	for _, route := range routez.Routes {
+		peers.Routes = append(peers.Routes, natsinfo.RouteStatus{RemoteID: route.RemoteID})
+	}
+	established := len(peers.RemoteIDs())
+	if established < expectedRoutes {
+		return fmt.Errorf("%d of %d expected routes established", established, expectedRoutes)
+	}
+	return nil
+}
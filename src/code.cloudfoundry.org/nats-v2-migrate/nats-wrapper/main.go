@@ -1,12 +1,20 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
+	"runtime"
+	"strconv"
 	"sync"
 	"syscall"
 	"time"
@@ -24,10 +32,20 @@ import (
 
 const (
 	NATSShutdownTimeout = 2 * time.Second
+	// StopDrainTimeout caps lame duck mode when the job stops. bpm kills the
+	// wrapper 20 seconds after it sent SIGTERM, and when nats is still running
+	// after lame duck mode stopping it takes up to two NATSShutdownTimeout.
+	StopDrainTimeout = 14 * time.Second
 )
 
+// ForwardedSignals are passed through to nats while it keeps running: SIGHUP
+// reloads its config, SIGUSR1 reopens its log file and SIGUSR2 puts it into
+// lame duck mode.
+var ForwardedSignals = []os.Signal{syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGUSR2}
+
 func main() {
 	configFilePath := flag.String("config-file", "", "path to config file")
+	resetState := flag.Bool("reset-state", false, "remove the recorded migration state and exit")
 	flag.Parse()
 
 	cfg, err := config.NewConfig(*configFilePath)
@@ -38,21 +56,85 @@ func main() {
 
 	logger, _ := lagerflags.NewFromConfig("nats-migrate-server", lagerflags.LagerConfig{LogLevel: lagerflags.INFO, TimeFormat: lagerflags.FormatRFC3339})
 
-	migrateCh := make(chan struct{})
+	if *resetState {
+		err = ResetMigrationState(cfg.NATSStateFile)
+		if err != nil {
+			logger.Fatal("resetting-migration-state-failed", err, lager.Data{"state_file": cfg.NATSStateFile})
+		}
+		logger.Info("reset-migration-state", lager.Data{"state_file": cfg.NATSStateFile})
+		return
+	}
+
+	binaries, err := cfg.Binaries()
+	if err != nil {
+		logger.Fatal("invalid-nats-binaries", err)
+	}
+
+	if cfg.NATSPidFile != "" {
+		err = CheckOrphanedNATS(logger, cfg.NATSPidFile, cfg.NATSOrphanPolicy, binaries, cfg.NATSConfigPath)
+		if err != nil {
+			logger.Fatal("checking-orphaned-nats-failed", err)
+		}
+	}
+
+	migrateCh := make(chan int)
 	migrateFinished := make(chan error)
+	rollbackCh := make(chan struct{})
+	rollbackFinished := make(chan error)
+	reloadCh := make(chan struct{})
+	memoryRestartCh := make(chan struct{})
 
-	natsBinPath, err := getNATSBinPath(cfg, logger)
+	// sigmon stops the whole group on any signal it receives, so the
+	// forwarded signals bypass it.
+	forwardSignals := make(chan os.Signal, 1)
+	signal.Notify(forwardSignals, ForwardedSignals...)
+
+	// Stop probing peers when bpm stops the job during startup.
+	probeCtx, stopProbing := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	natsBinary, err := getNATSBinary(probeCtx, cfg, binaries, logger)
+	stopProbing()
 	if err != nil {
-		logger.Fatal("getting-nats-bin-path", err)
+		logger.Fatal("getting-nats-binary", err)
 	}
 
 	natsRunner := &NATSRunner{
-		Logger:          logger,
-		BinPath:         natsBinPath,
-		V2BinPath:       cfg.NATSV2BinPath,
-		ConfigPath:      cfg.NATSConfigPath,
-		MigrateCh:       migrateCh,
-		MigrateFinished: migrateFinished,
+		Logger:              logger,
+		Binaries:            binaries,
+		Current:             natsBinary,
+		ConfigPath:          cfg.NATSConfigPath,
+		PidFile:             cfg.NATSPidFile,
+		StateFile:           cfg.NATSStateFile,
+		LameDuckDuration:    time.Duration(cfg.NATSLameDuckDuration),
+		LameDuckGracePeriod: time.Duration(cfg.NATSLameDuckGracePeriod),
+		MigrateCh:           migrateCh,
+		MigrateFinished:     migrateFinished,
+		RollbackCh:          rollbackCh,
+		RollbackFinished:    rollbackFinished,
+		ReloadCh:            reloadCh,
+		MemoryRestartCh:     memoryRestartCh,
+		ForwardSignals:      forwardSignals,
+	}
+	if cfg.NATSSupervise {
+		natsRunner.RestartPolicy = NewRestartPolicy(cfg)
+	}
+	if !cfg.NATSLogPassthrough {
+		// nats decides which levels it writes
+		natsRunner.OutputLogger, _ = lagerflags.NewFromConfig("nats", lagerflags.LagerConfig{LogLevel: lagerflags.DEBUG, TimeFormat: lagerflags.FormatRFC3339})
+	}
+	if cfg.NATSEmbedded {
+		natsRunner.EmbeddedBinary, err = embeddedBinary(binaries)
+		if err != nil {
+			logger.Fatal("embedding-nats-failed", err)
+		}
+		logger.Info("embedding-nats", lager.Data{"binary": natsRunner.EmbeddedBinary, "version": EmbeddedNATSVersion})
+	}
+	memoryWatchdog, err := NewMemoryWatchdog(logger, cfg, natsRunner, memoryRestartCh)
+	if err != nil {
+		logger.Fatal("invalid-memory-limits", err)
+	}
+	natsRunner.ReadinessCheck, err = NewReadinessCheck(cfg)
+	if err != nil {
+		logger.Fatal("building-readiness-check-failed", err)
 	}
 
 	tlsConfig, err := tlsconfig.Build(
@@ -63,18 +145,51 @@ func main() {
 		logger.Fatal("tls-configuration-failed", err)
 	}
 
-	httpServer := NewHttpServer(logger, cfg, migrateCh, migrateFinished)
+	localProber, err := cfg.Prober()
+	if err != nil {
+		logger.Fatal("building-nats-prober-failed", err)
+	}
+	// /status and /health should answer quickly when nats is down
+	localProber.Retries = 1
+	localProber.Deadline = 0
+
+	httpServer := NewHttpServer(logger, cfg, natsRunner, localProber, migrateCh, migrateFinished, rollbackCh, rollbackFinished)
 
 	sm := http.NewServeMux()
 	sm.HandleFunc("/info", httpServer.Info)
 	sm.HandleFunc("/migrate", httpServer.Migrate)
+	sm.HandleFunc("/migrate/status", httpServer.MigrationStatus)
+	sm.HandleFunc("/rollback", httpServer.Rollback)
+	sm.HandleFunc("/status", httpServer.Status)
+	sm.HandleFunc("/health", httpServer.Health)
 
-	migrateServer := http_server.NewTLSServer(fmt.Sprintf("0.0.0.0:%d", cfg.NATSMigratePort), sm, tlsConfig)
+	handler := authorizeClients(logger, ClientAllowlist(cfg.NATSMigrateAuthorizedClients), sm)
+	migrateServer := http_server.NewTLSServer(fmt.Sprintf("0.0.0.0:%d", cfg.NATSMigratePort), handler, tlsConfig)
 
 	members := grouper.Members{
 		{Name: "nats-runner", Runner: natsRunner},
 		{Name: "migrate-server", Runner: migrateServer},
 	}
+	if cfg.NATSConfigPath != "" {
+		members = append(members, grouper.Member{Name: "config-watcher", Runner: newConfigWatcher(logger, cfg, reloadCh)})
+	}
+	if memoryWatchdog != nil {
+		members = append(members, grouper.Member{Name: "memory-watchdog", Runner: memoryWatchdog})
+	}
+	if cfg.NATSMetricsPort != 0 {
+		if cfg.NATSMonitorPort == 0 {
+			logger.Info("serving-only-wrapper-metrics-without-nats-monitor-port")
+		}
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("/metrics", &MetricsExporter{
+			Logger:         logger.Session("metrics"),
+			Prober:         localProber,
+			NATSMachineUrl: fmt.Sprintf("%s:%d", cfg.Address, cfg.NATSPort),
+			NATSRunner:     natsRunner,
+		})
+		metricsServer := http_server.New(fmt.Sprintf("0.0.0.0:%d", cfg.NATSMetricsPort), metricsMux)
+		members = append(members, grouper.Member{Name: "metrics-server", Runner: metricsServer})
+	}
 	group := grouper.NewOrdered(os.Interrupt, members)
 
 	monitor := ifrit.Invoke(sigmon.New(group))
@@ -87,47 +202,208 @@ func main() {
 	}
 }
 
-func getNATSBinPath(cfg config.Config, logger lager.Logger) (string, error) {
+func newConfigWatcher(logger lager.Logger, cfg config.Config, reloadCh chan<- struct{}) *ConfigWatcher {
+	watcher := &ConfigWatcher{
+		Logger:     logger,
+		ConfigPath: cfg.NATSConfigPath,
+		Interval:   DefaultConfigWatchInterval,
+		Debounce:   DefaultConfigReloadDebounce,
+		ReloadCh:   reloadCh,
+	}
+	if cfg.NATSConfigWatchInterval > 0 {
+		watcher.Interval = time.Duration(cfg.NATSConfigWatchInterval)
+	}
+	if cfg.NATSConfigReloadDebounce > 0 {
+		watcher.Debounce = time.Duration(cfg.NATSConfigReloadDebounce)
+	}
+	return watcher
+}
+
+// getNATSBinary returns the position in binaries of the binary to start.
+// Unless the binary is overridden or recorded in the state file, the
+// BinaryQuorum selects it from the binaries the peers run, so that a restarted
+// node never gets ahead of a cluster that has not finished migrating.
+func getNATSBinary(ctx context.Context, cfg config.Config, binaries config.NATSBinaries, logger lager.Logger) (int, error) {
+	if cfg.NATSBinaryOverride != "" {
+		i, ok := binaries.Find(cfg.NATSBinaryOverride)
+		if !ok {
+			return 0, fmt.Errorf("invalid nats_binary_override %q, there is no nats binary with that name", cfg.NATSBinaryOverride)
+		}
+		logger.Info("binary-override", lager.Data{"binary": binaries[i].Name})
+		return i, nil
+	}
+
+	if cfg.NATSStateFile != "" {
+		state, err := LoadMigrationState(cfg.NATSStateFile)
+		if err != nil {
+			logger.Error("ignoring-unreadable-migration-state", err)
+		} else if state != nil {
+			data := lager.Data{"state_file": cfg.NATSStateFile, "binary": state.Binary, "changed_at": state.ChangedAt, "reason": state.Reason}
+			i, ok := binaries.Find(state.Binary)
+			if ok {
+				logger.Info("found-migration-state", data)
+				return i, nil
+			}
+			logger.Error("ignoring-migration-state-for-unknown-binary", fmt.Errorf("there is no nats binary called %s", state.Binary), data)
+		}
+	}
+
+	newest := binaries.Newest()
 	if len(cfg.NATSInstances) == 1 {
-		logger.Info("single-instance-nats-cluster.starting-as-v2")
-		return cfg.NATSV2BinPath, nil
+		logger.Info("single-instance-nats-cluster", lager.Data{"binary": binaries[newest].Name})
+		return newest, nil
+	}
+	prober, err := cfg.Prober()
+	if err != nil {
+		return 0, err
 	}
 	localNATSMachineUrl := fmt.Sprintf("%s:%d", cfg.Address, cfg.NATSPort)
+	var peers []string
 	for _, natsMachineUrl := range cfg.NATSInstances {
-		if natsMachineUrl == localNATSMachineUrl {
+		if natsMachineUrl != localNATSMachineUrl {
+			peers = append(peers, natsMachineUrl)
+		}
+	}
+
+	return selectPeerBinary(ctx, cfg, prober, peers, binaries, logger)
+}
+
+// checkPeerRoutes logs peers that answer on the client port but whose route
+// listener is down, belongs to another server, or reports another cluster.
+// The route listeners are probed concurrently and logged in the order of
+// results.
+func checkPeerRoutes(ctx context.Context, prober *natsinfo.Prober, clusterPort int, results []natsinfo.SurveyResult, logger lager.Logger) {
+	routeProber := *prober
+	routeProber.Retries = 1
+	routeProber.MonitorPort = 0
+	// gnatsd sends the route INFO before the TLS handshake
+	v1RouteProber := routeProber
+	v1RouteProber.RouteTLSConfig = nil
+
+	type routeProbe struct {
+		url  string
+		info *natsinfo.RouteInfo
+		err  error
+	}
+	probes := make([]*routeProbe, len(results))
+	wg := sync.WaitGroup{}
+	for i, result := range results {
+		if result.Info == nil {
 			continue
 		}
-		majorVersion, err := natsinfo.GetMajorVersion(natsMachineUrl)
+
+		host, _, err := net.SplitHostPort(result.Instance)
 		if err != nil {
-			if _, ok := err.(*natsinfo.ErrConnectingToNATS); ok {
-				logger.Error("ignoring-machine-due-to-connection-error", err, lager.Data{"url": natsMachineUrl})
-				continue
-			}
-			logger.Error("error-getting-nats-version", err)
-			return "", err
+			continue
 		}
-		if majorVersion < 2 {
-			logger.Info("starting-as-v1", lager.Data{"instance": natsMachineUrl, "version": majorVersion})
+		probe := &routeProbe{url: net.JoinHostPort(host, strconv.Itoa(clusterPort))}
+		probes[i] = probe
 
-			return cfg.NATSV1BinPath, nil
-		} else {
-			logger.Info("found-v2-instance", lager.Data{"instance": natsMachineUrl, "version": majorVersion})
+		p := &routeProber
+		if result.Info.SemVer.Major < 2 {
+			p = &v1RouteProber
 		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			probe.info, probe.err = p.GetRouteInfo(ctx, probe.url)
+		}()
+	}
+	wg.Wait()
+
+	clusters := map[string][]string{}
+	for i, result := range results {
+		probe := probes[i]
+		if probe == nil {
+			continue
+		}
+		if probe.err != nil {
+			logger.Error("peer-route-listener-unreachable", probe.err, lager.Data{"instance": result.Instance, "route": probe.url})
+			continue
+		}
+
+		data := lager.Data{
+			"instance":     result.Instance,
+			"route":        probe.url,
+			"server_id":    probe.info.ServerID,
+			"cluster":      probe.info.Cluster,
+			"tls_required": probe.info.TLSRequired,
+		}
+		if probe.info.ServerID != result.Info.ServerID {
+			logger.Error("peer-route-listener-belongs-to-another-server", fmt.Errorf("client port reports server %s", result.Info.ServerID), data)
+			continue
+		}
+
+		logger.Info("found-peer-route-listener", data)
+		clusters[probe.info.Cluster] = append(clusters[probe.info.Cluster], result.Instance)
+	}
+
+	if len(clusters) > 1 {
+		logger.Error("peers-report-different-cluster-names", errors.New("peers are not part of the same cluster"), lager.Data{"clusters": clusters})
 	}
-	return cfg.NATSV2BinPath, nil
 }
 
 type NATSRunner struct {
-	Logger          lager.Logger
-	BinPath         string
-	V2BinPath       string
-	ConfigPath      string
-	MigrateCh       <-chan struct{}
+	Logger lager.Logger
+	// Binaries are the nats builds the runner switches between, and Current
+	// is the position of the one that runs.
+	Binaries   config.NATSBinaries
+	Current    int
+	ConfigPath string
+	// PidFile is where the pid of a nats child process is recorded, so that
+	// the next wrapper finds it if this one is killed. Nothing is recorded
+	// when it is empty.
+	PidFile string
+	// StateFile is where the binary is recorded after a migration or
+	// rollback. Nothing is recorded when it is empty.
+	StateFile string
+	// LameDuckDuration and LameDuckGracePeriod match the lame duck settings
+	// of the nats config. When LameDuckDuration is zero nats is interrupted
+	// and killed after NATSShutdownTimeout instead.
+	LameDuckDuration    time.Duration
+	LameDuckGracePeriod time.Duration
+	// RestartPolicy is set to restart nats when it crashes instead of
+	// exiting and leaving the restart to monit.
+	RestartPolicy *RestartPolicy
+	// ReadinessCheck is set to wait for nats to become ready after a
+	// migration or rollback before reporting success.
+	ReadinessCheck *ReadinessCheck
+	// EmbeddedBinary is the name of the binary that runs in-process as an
+	// EmbeddedNATS instead of as a child process. It is empty when nothing
+	// is embedded.
+	EmbeddedBinary string
+	// OutputLogger re-emits the output of nats as lager JSON. The output is
+	// passed through as is when it is nil.
+	OutputLogger lager.Logger
+	// MigrateCh receives the position in Binaries to migrate to.
+	MigrateCh       <-chan int
 	MigrateFinished chan<- error
+	// RollbackCh asks to go back to the binary before Current.
+	RollbackCh       <-chan struct{}
+	RollbackFinished chan<- error
+	// ReloadCh receives when the nats config or its TLS files changed.
+	ReloadCh <-chan struct{}
+	// MemoryRestartCh receives when nats uses more memory than it may.
+	MemoryRestartCh <-chan struct{}
+	// ForwardSignals receives signals to pass through to nats.
+	ForwardSignals <-chan os.Signal
+
+	state natsState
 }
 
 func (r *NATSRunner) Run(signals <-chan os.Signal, ready chan<- struct{}) error {
-	natsSession, err := NewNATSSession(r.BinPath, r.ConfigPath)
+	if r.Current == r.Binaries.Newest() {
+		r.state.setMigration(MigrationNotNeeded)
+	} else {
+		r.state.setMigration(MigrationNotStarted)
+	}
+
+	err := r.validateConfig(r.Current)
+	if err != nil {
+		r.Logger.Error("invalid-nats-config", err, lager.Data{"binary": r.Binaries[r.Current].Name})
+		return err
+	}
+	natsSession, err := r.startSession(r.Current)
 	if err != nil {
 		return err
 	}
@@ -135,69 +411,425 @@ func (r *NATSRunner) Run(signals <-chan os.Signal, ready chan<- struct{}) error
 
 	close(ready)
 
+	// exited is nil while waiting to restart a crashed nats
+	exited := natsSession.Exited()
+	var restart <-chan time.Time
 	for {
 		select {
-		case <-r.MigrateCh:
-			r.Logger.Info("received-migration-signal")
-			if r.BinPath == r.V2BinPath {
-				r.Logger.Info("skipping-migration-already-on-v2")
+		case target := <-r.MigrateCh:
+			data := lager.Data{"from": r.Binaries[r.Current].Name, "to": r.Binaries[target].Name}
+			r.Logger.Info("received-migration-signal", data)
+			if target == r.Current {
+				// a failed migration leaves nats on the target, so a retry
+				// only has to wait for it to become ready
+				r.Logger.Info("skipping-migration-already-on-target", data)
+				err = r.waitUntilReady(natsSession)
+				if err != nil {
+					r.MigrateFinished <- err
+					break
+				}
+				if r.state.status().Migration == MigrationFailed {
+					r.state.setMigration(MigrationSucceeded)
+				}
+				r.saveState(target, StateReasonMigrate)
 				r.MigrateFinished <- nil
 				break
 			}
-			natsSession.Shutdown()
-
-			natsSession, err = NewNATSSession(r.V2BinPath, r.ConfigPath)
+			// keep the running nats when the target would reject the config
+			err = r.validateConfig(target)
+			if err != nil {
+				r.Logger.Error("refusing-migration-invalid-nats-config", err, data)
+				r.MigrateFinished <- err
+				break
+			}
+			r.state.setMigration(MigrationInProgress)
+			natsSession, err = r.switchBinary(natsSession, target)
 			if err != nil {
+				r.state.setMigration(MigrationFailed)
 				r.MigrateFinished <- err
 				return err
 			}
+			exited, restart = natsSession.Exited(), nil
+
+			err = r.waitUntilReady(natsSession)
+			if err != nil {
+				r.state.setMigration(MigrationFailed)
+				r.MigrateFinished <- err
+				break
+			}
+			r.state.setMigration(MigrationSucceeded)
+			r.saveState(target, StateReasonMigrate)
 
-			r.Logger.Info("migrated-to-v2")
+			r.Logger.Info("migrated", data)
 			r.MigrateFinished <- nil
+		case <-r.RollbackCh:
+			r.Logger.Info("received-rollback-signal")
+			if r.Current == 0 {
+				r.Logger.Info("skipping-rollback-already-on-oldest-binary", lager.Data{"binary": r.Binaries[r.Current].Name})
+				r.RollbackFinished <- nil
+				break
+			}
+			target := r.Current - 1
+			data := lager.Data{"from": r.Binaries[r.Current].Name, "to": r.Binaries[target].Name}
+
+			err = r.validateConfig(target)
+			if err != nil {
+				r.Logger.Error("refusing-rollback-invalid-nats-config", err, data)
+				r.RollbackFinished <- err
+				break
+			}
+			r.state.setMigration(RollbackInProgress)
+			natsSession, err = r.switchBinary(natsSession, target)
+			if err != nil {
+				r.state.setMigration(RollbackFailed)
+				r.RollbackFinished <- err
+				return err
+			}
+			exited, restart = natsSession.Exited(), nil
+
+			err = r.waitUntilReady(natsSession)
+			if err != nil {
+				r.state.setMigration(RollbackFailed)
+				r.RollbackFinished <- err
+				break
+			}
+			r.state.setMigration(RolledBack)
+			r.saveState(target, StateReasonRollback)
+
+			r.Logger.Info("rolled-back", data)
+			r.RollbackFinished <- nil
 		case signal := <-signals:
+			if !isTerminationSignal(signal) {
+				r.forwardSignal(natsSession, exited, signal)
+				break
+			}
 			r.Logger.Info("signalled-nats")
+			if r.LameDuckDuration > 0 && (signal == os.Interrupt || signal == syscall.SIGTERM) {
+				r.shutdown(natsSession, StopDrainTimeout)
+				return nil
+			}
 			natsSession.Signal(signal)
 			return nil
-		case <-natsSession.Exited:
+		case <-exited:
 			r.Logger.Info("exited-nats")
+			r.state.exited(natsSession.ExitCode())
 			if natsSession.ExitCode() == 0 {
 				return nil
 			}
 
-			return fmt.Errorf("exit status %d", natsSession.ExitCode())
+			err := fmt.Errorf("exit status %d", natsSession.ExitCode())
+			if r.RestartPolicy == nil {
+				return err
+			}
+			r.Logger.Error("nats-crashed", err, lager.Data{"exit_code": natsSession.ExitCode(), "stderr": natsSession.StderrLines()})
+
+			backoff, err := r.RestartPolicy.Crashed(time.Now())
+			if err != nil {
+				r.Logger.Error("giving-up-restarting-nats", err)
+				return err
+			}
+			r.Logger.Info("restarting-nats", lager.Data{"backoff": backoff.String()})
+			exited, restart = nil, time.After(backoff)
+		case <-r.ReloadCh:
+			if exited == nil {
+				r.Logger.Info("skipping-reload-nats-not-running")
+				break
+			}
+			err := r.validateConfig(r.Current)
+			if err != nil {
+				r.Logger.Error("skipping-reload-invalid-nats-config", err, lager.Data{"binary": r.Binaries[r.Current].Name})
+				break
+			}
+			err = natsSession.Reload()
+			if err != nil {
+				r.Logger.Error("reloading-nats-failed", err)
+				break
+			}
+			r.Logger.Info("reloaded-nats")
+		case <-r.MemoryRestartCh:
+			if exited == nil {
+				r.Logger.Info("skipping-memory-restart-nats-not-running")
+				break
+			}
+			r.Logger.Info("restarting-nats-above-memory-limit")
+			r.shutdown(natsSession, 0)
+			r.state.exited(natsSession.ExitCode())
+
+			err = r.validateConfig(r.Current)
+			if err != nil {
+				r.Logger.Error("invalid-nats-config", err, lager.Data{"binary": r.Binaries[r.Current].Name})
+				return err
+			}
+			natsSession, err = r.startSession(r.Current)
+			if err != nil {
+				return err
+			}
+			r.state.restarted()
+			r.Logger.Info("restarted-nats")
+			exited = natsSession.Exited()
+		case signal := <-r.ForwardSignals:
+			r.forwardSignal(natsSession, exited, signal)
+		case <-restart:
+			err = r.validateConfig(r.Current)
+			if err != nil {
+				r.Logger.Error("invalid-nats-config", err, lager.Data{"binary": r.Binaries[r.Current].Name})
+				return err
+			}
+			natsSession, err = r.startSession(r.Current)
+			if err != nil {
+				return err
+			}
+			r.state.restarted()
+			r.Logger.Info("restarted-nats")
+			exited, restart = natsSession.Exited(), nil
 		}
 	}
 }
 
+// forwardSignal passes signal to nats unless it is waiting to be restarted.
+// nats exits by itself at the end of lame duck mode, which ends the runner as
+// if nats had been stopped.
+func (r *NATSRunner) forwardSignal(natsSession NATSProcess, exited <-chan struct{}, signal os.Signal) {
+	data := lager.Data{"signal": signal.String()}
+	if exited == nil {
+		r.Logger.Info("skipping-forwarding-signal-nats-not-running", data)
+		return
+	}
+	if signal == syscall.SIGHUP {
+		err := r.validateConfig(r.Current)
+		if err != nil {
+			r.Logger.Error("skipping-reload-invalid-nats-config", err, lager.Data{"binary": r.Binaries[r.Current].Name})
+			return
+		}
+	}
+	natsSession.Signal(signal)
+	r.Logger.Info("forwarded-signal-to-nats", data)
+}
+
+// validateConfig checks ConfigPath the way the binary at position binary
+// loads it, so that nats is never started or reloaded with a config it
+// rejects.
+func (r *NATSRunner) validateConfig(binary int) error {
+	return validateConfigFor(r.Binaries[binary], r.ConfigPath, r.Binaries[binary].Name == r.EmbeddedBinary)
+}
+
+func isTerminationSignal(signal os.Signal) bool {
+	return signal == os.Interrupt || signal == syscall.SIGTERM || signal == os.Kill
+}
+
+// startSession starts the binary at position binary in Binaries.
+func (r *NATSRunner) startSession(binary int) (NATSProcess, error) {
+	var output *natsLog
+	if r.OutputLogger != nil {
+		output = newNATSLog(r.OutputLogger, r.Binaries[binary].Name)
+	}
+
+	if r.Binaries[binary].Name == r.EmbeddedBinary {
+		embedded, err := NewEmbeddedNATS(r.ConfigPath, output)
+		if err != nil {
+			return nil, err
+		}
+		r.state.started(r.Binaries[binary].Name, "", embedded.PID(), true)
+		return embedded, nil
+	}
+
+	var stderrTail *lineTail
+	if r.RestartPolicy != nil {
+		stderrTail = newLineTail(StderrTailLines)
+	}
+	natsSession, err := NewNATSSession(r.Binaries[binary].BinPath, r.ConfigPath, stderrTail, output, r.PidFile)
+	if err != nil {
+		return nil, err
+	}
+
+	r.state.started(r.Binaries[binary].Name, r.Binaries[binary].BinPath, natsSession.PID(), false)
+
+	return natsSession, nil
+}
+
+// switchBinary stops nats and starts the binary at position target instead.
+func (r *NATSRunner) switchBinary(natsSession NATSProcess, target int) (NATSProcess, error) {
+	r.shutdown(natsSession, 0)
+	r.state.exited(natsSession.ExitCode())
+
+	natsSession, err := r.startSession(target)
+	if err != nil {
+		return nil, err
+	}
+	r.Current = target
+
+	return natsSession, nil
+}
+
+// waitUntilReady runs the ReadinessCheck against the nats that was just
+// started. Without a ReadinessCheck nats counts as ready once it started.
+func (r *NATSRunner) waitUntilReady(natsSession NATSProcess) error {
+	if r.ReadinessCheck == nil {
+		return nil
+	}
+
+	data := lager.Data{"timeout": r.ReadinessCheck.Timeout.String(), "expected_routes": r.ReadinessCheck.ExpectedRoutes}
+	r.Logger.Info("waiting-for-nats-to-become-ready", data)
+	err := r.ReadinessCheck.Wait(natsSession)
+	if err != nil {
+		r.Logger.Error("nats-did-not-become-ready", err, data)
+		return err
+	}
+	r.Logger.Info("nats-is-ready", data)
+	return nil
+}
+
+// saveState records the binary at position binary in StateFile. Failing to record it does not
+// undo the switch, it only means that a restart probes the peers again.
+func (r *NATSRunner) saveState(binary int, reason string) {
+	if r.StateFile == "" {
+		return
+	}
+
+	state := MigrationState{Binary: r.Binaries[binary].Name, ChangedAt: time.Now().UTC(), Reason: reason}
+	err := state.Save(r.StateFile)
+	if err != nil {
+		r.Logger.Error("saving-migration-state-failed", err, lager.Data{"state_file": r.StateFile})
+		return
+	}
+	r.Logger.Info("saved-migration-state", lager.Data{"state_file": r.StateFile, "binary": state.Binary, "reason": reason})
+}
+
+// Status reports which nats binary runs and how it has been doing. The
+// version is left for the caller to probe.
+func (r *NATSRunner) Status() NATSStatus {
+	return r.state.status()
+}
+
+// shutdown stops nats and waits for it to exit. In lame duck mode nats stops
+// accepting clients and closes the existing connections over
+// LameDuckDuration, so that they reconnect to the peers one by one. A
+// positive limit cuts lame duck mode short after it, which leaves the clients
+// that are still connected then to reconnect at once.
+func (r *NATSRunner) shutdown(natsSession NATSProcess, limit time.Duration) {
+	if r.LameDuckDuration <= 0 {
+		natsSession.Shutdown()
+		return
+	}
+
+	timeout := r.LameDuckDuration + r.LameDuckGracePeriod + NATSShutdownTimeout
+	if limit > 0 {
+		timeout = min(timeout, limit)
+	}
+	data := lager.Data{"duration": r.LameDuckDuration.String(), "grace_period": r.LameDuckGracePeriod.String(), "timeout": timeout.String()}
+	r.Logger.Info("entering-lame-duck-mode", data)
+	if natsSession.LameDuckShutdown(timeout) {
+		r.Logger.Info("finished-lame-duck-mode", data)
+		return
+	}
+	r.Logger.Info("lame-duck-mode-timed-out", data)
+}
+
+// NATSProcess is a running nats, either a child process or a server embedded
+// in the wrapper.
+type NATSProcess interface {
+	// Exited is closed once nats stopped.
+	Exited() <-chan struct{}
+	ExitCode() int
+	PID() int
+	Signal(signal os.Signal)
+	Reload() error
+	Shutdown()
+	LameDuckShutdown(timeout time.Duration) bool
+	// StderrLines returns the last lines nats wrote to stderr, if they are
+	// kept.
+	StderrLines() []string
+}
+
+// NATSSession runs a nats binary as a child process.
 type NATSSession struct {
-	Exited   <-chan struct{}
+	exited   <-chan struct{}
 	lock     *sync.Mutex
 	exitCode int
+	// StderrTail keeps the last lines nats wrote to stderr when it is set.
+	StderrTail *lineTail
+	// Output re-emits the output of nats when it is set.
+	Output *natsLog
+	// PidFile records the pid of nats while it runs when it is set.
+	PidFile string
 
 	command *exec.Cmd
 }
 
-func NewNATSSession(binPath string, configPath string) (*NATSSession, error) {
+func NewNATSSession(binPath string, configPath string, stderrTail *lineTail, output *natsLog, pidFile string) (*NATSSession, error) {
 	exited := make(chan struct{})
 
 	session := &NATSSession{
-		command:  exec.Command(binPath, "-c", configPath),
-		Exited:   exited,
-		lock:     &sync.Mutex{},
-		exitCode: -1,
+		command:    exec.Command(binPath, "-c", configPath),
+		exited:     exited,
+		lock:       &sync.Mutex{},
+		exitCode:   -1,
+		StderrTail: stderrTail,
+		Output:     output,
+		PidFile:    pidFile,
+	}
+	session.command.SysProcAttr = childSysProcAttr()
+
+	var stdout, stderr io.Writer = os.Stdout, os.Stderr
+	if output != nil {
+		stdout, stderr = output.writer(false), output.writer(true)
 	}
+	if stderrTail != nil {
+		stderr = io.MultiWriter(stderr, stderrTail)
+	}
+	session.command.Stdout = stdout
+	session.command.Stderr = stderr
 
-	session.command.Stdout = os.Stdout
-	session.command.Stderr = os.Stderr
+	// The kernel sends the Pdeathsig of childSysProcAttr when the thread that
+	// started nats exits, not the wrapper. The goroutine that starts nats
+	// keeps its thread locked until nats exited, so that Go does not retire
+	// the thread while nats runs.
+	started := make(chan error)
+	go func() {
+		// the thread is never unlocked, so Go terminates it once nats exited
+		runtime.LockOSThread()
 
-	err := session.command.Start()
+		err := session.start()
+		started <- err
+		if err != nil {
+			return
+		}
+		session.waitForExit(exited)
+	}()
+
+	err := <-started
 	if err != nil {
 		return nil, err
 	}
+	return session, nil
+}
 
-	go session.waitForExit(exited)
+// start starts nats and records its pid in PidFile.
+func (s *NATSSession) start() error {
+	err := s.command.Start()
+	if err != nil {
+		return err
+	}
 
-	return session, nil
+	if s.PidFile != "" {
+		err = writePidFile(s.PidFile, s.PID())
+		if err != nil {
+			// #nosec G104 - nats is stopped because its pid could not be recorded, the write error is what matters
+			s.command.Process.Kill()
+			// #nosec G104 - only reaps the killed nats
+			s.command.Wait()
+			return fmt.Errorf("writing pid file: %w", err)
+		}
+	}
+	return nil
+}
+
+func (s *NATSSession) Exited() <-chan struct{} {
+	return s.exited
+}
+
+func (s *NATSSession) StderrLines() []string {
+	return s.StderrTail.Lines()
 }
 
 func (s *NATSSession) Signal(signal os.Signal) {
@@ -210,7 +842,7 @@ func (s *NATSSession) Shutdown() {
 
 	t := time.NewTimer(NATSShutdownTimeout)
 	select {
-	case <-s.Exited:
+	case <-s.exited:
 		return
 	case <-t.C:
 		s.Signal(os.Kill)
@@ -218,13 +850,39 @@ func (s *NATSSession) Shutdown() {
 	t.Reset(NATSShutdownTimeout)
 
 	select {
-	case <-s.Exited:
+	case <-s.exited:
 		return
 	case <-t.C:
 		return
 	}
 }
 
+func (s *NATSSession) PID() int {
+	return s.command.Process.Pid
+}
+
+// Reload asks nats to reload its config and TLS certificates.
+func (s *NATSSession) Reload() error {
+	return s.command.Process.Signal(syscall.SIGHUP)
+}
+
+// LameDuckShutdown puts nats into lame duck mode and waits up to timeout for
+// it to exit after closing its client connections. It falls back to Shutdown
+// when nats is still running after timeout and reports whether it drained.
+func (s *NATSSession) LameDuckShutdown(timeout time.Duration) bool {
+	s.Signal(syscall.SIGUSR2)
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case <-s.exited:
+		return true
+	case <-t.C:
+		s.Shutdown()
+		return false
+	}
+}
+
 func (s *NATSSession) ExitCode() int {
 	s.lock.Lock()
 	defer s.lock.Unlock()
@@ -234,6 +892,13 @@ func (s *NATSSession) ExitCode() int {
 func (s *NATSSession) waitForExit(exited chan<- struct{}) {
 	// #nosec G104 - before calling waitForExit we check to ensure the process started, and we check exit code further down.
 	s.command.Wait()
+	if s.Output != nil {
+		s.Output.Flush()
+	}
+	if s.PidFile != "" {
+		// #nosec G104 - a pidfile that is left behind is removed by the orphan check of the next start
+		removePidFile(s.PidFile, s.PID())
+	}
 	status := s.command.ProcessState.Sys().(syscall.WaitStatus)
 	s.lock.Lock()
 	s.exitCode = status.ExitStatus()
@@ -242,22 +907,30 @@ func (s *NATSSession) waitForExit(exited chan<- struct{}) {
 }
 
 type httpServer struct {
-	logger                lager.Logger
-	migrateEndpointHit    bool
-	migrateEndpointHitMux *sync.Mutex
-	cfg                   config.Config
-	migrateCh             chan<- struct{}
-	migrateFinished       <-chan error
+	logger           lager.Logger
+	migrateState     *migrateStateMachine
+	switchMux        *sync.Mutex
+	cfg              config.Config
+	natsRunner       *NATSRunner
+	prober           *natsinfo.Prober
+	migrateCh        chan<- int
+	migrateFinished  <-chan error
+	rollbackCh       chan<- struct{}
+	rollbackFinished <-chan error
 }
 
-func NewHttpServer(logger lager.Logger, cfg config.Config, migrateCh chan<- struct{}, migrateFinished <-chan error) *httpServer {
+func NewHttpServer(logger lager.Logger, cfg config.Config, natsRunner *NATSRunner, prober *natsinfo.Prober, migrateCh chan<- int, migrateFinished <-chan error, rollbackCh chan<- struct{}, rollbackFinished <-chan error) *httpServer {
 	return &httpServer{
-		logger:                logger,
-		migrateEndpointHit:    false,
-		migrateEndpointHitMux: &sync.Mutex{},
-		cfg:                   cfg,
-		migrateCh:             migrateCh,
-		migrateFinished:       migrateFinished,
+		logger:           logger,
+		migrateState:     newMigrateStateMachine(),
+		switchMux:        &sync.Mutex{},
+		cfg:              cfg,
+		natsRunner:       natsRunner,
+		prober:           prober,
+		migrateCh:        migrateCh,
+		migrateFinished:  migrateFinished,
+		rollbackCh:       rollbackCh,
+		rollbackFinished: rollbackFinished,
 	}
 }
 
@@ -281,26 +954,180 @@ func (s *httpServer) Info(w http.ResponseWriter, req *http.Request) {
 	w.Write(jsonResponse)
 }
 
+// Status reports the state of the local nats process together with the
+// version it reports on its client port.
+func (s *httpServer) Status(w http.ResponseWriter, req *http.Request) {
+	status := s.natsRunner.Status()
+	if status.Running {
+		info, err := s.prober.GetServerInfo(req.Context(), s.localNATSMachineUrl())
+		if err != nil {
+			s.logger.Info("status-probing-nats-failed", lager.Data{"error": err.Error()})
+		} else {
+			status.Version = info.Version
+		}
+	}
+
+	s.writeJSON(w, http.StatusOK, status)
+}
+
+// Health reports whether the local nats accepts client connections.
+func (s *httpServer) Health(w http.ResponseWriter, req *http.Request) {
+	response := map[string]interface{}{"healthy": false}
+
+	if !s.natsRunner.Status().Running {
+		response["error"] = "nats is not running"
+		s.writeJSON(w, http.StatusServiceUnavailable, response)
+		return
+	}
+
+	info, err := s.prober.Ping(req.Context(), s.localNATSMachineUrl())
+	if err != nil {
+		response["error"] = err.Error()
+		s.writeJSON(w, http.StatusServiceUnavailable, response)
+		return
+	}
+
+	response["healthy"] = true
+	response["version"] = info.Version
+	s.writeJSON(w, http.StatusOK, response)
+}
+
+func (s *httpServer) localNATSMachineUrl() string {
+	return fmt.Sprintf("%s:%d", s.cfg.Address, s.cfg.NATSPort)
+}
+
+func (s *httpServer) writeJSON(w http.ResponseWriter, statusCode int, response interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+
+	jsonResponse, err := json.Marshal(response)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		s.logger.Error("error-during-marshal", err)
+		// #nosec G104 - don't handle error writing http response. at best, we could log it and be susceptible to DoS's filling up disks with logs
+		w.Write(nil)
+		return
+	}
+
+	w.WriteHeader(statusCode)
+	// #nosec G104 - don't handle error writing http response. at best, we could log it and be susceptible to DoS's filling up disks with logs
+	w.Write(jsonResponse)
+}
+
+// MigrateRequest is the optional body of a /migrate call. Without a Target
+// the node migrates to the newest binary.
+type MigrateRequest struct {
+	Target string `json:"target"`
+}
+
+// Migrate switches the local nats to the target binary. Repeating a request
+// that succeeded or is in progress does not migrate again; the response is
+// the current MigrateStatus either way. /migrate/status serves reads.
 func (s *httpServer) Migrate(w http.ResponseWriter, req *http.Request) {
-	s.logger.Info("received-migrate-api-call")
-	s.migrateEndpointHitMux.Lock()
-	defer s.migrateEndpointHitMux.Unlock()
-	if s.migrateEndpointHit {
-		w.WriteHeader(http.StatusConflict)
+	if !requirePost(w, req) {
+		return
+	}
+
+	requestedBy := clientIdentity(req)
+	s.logger.Info("received-migrate-api-call", lager.Data{"requested_by": requestedBy})
+
+	target, err := s.migrationTarget(req)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		s.logger.Error("invalid-migrate-request", err)
 		// #nosec G104 - don't handle error writing http response. at best, we could log it and be susceptible to DoS's filling up disks with logs
 		w.Write(nil)
 		return
 	}
 
-	// migrateEndpointHit var guards against race condition,
-	// (multiple hits from different post-start instances)
-	s.migrateEndpointHit = true
+	// begin guards against several post-start instances migrating at once
+	status, started := s.migrateState.begin(s.natsRunner.Binaries[target].Name, requestedBy)
+	if !started {
+		s.logger.Info("skipping-migrate-api-call", lager.Data{"state": status.State, "target": status.Target})
+		statusCode := http.StatusOK
+		if status.State == MigrateStateInProgress || status.State == MigrateStateRollingBack {
+			statusCode = http.StatusConflict
+		}
+		s.writeJSON(w, statusCode, status)
+		return
+	}
 
-	s.migrateCh <- struct{}{}
-	err := <-s.migrateFinished
+	s.switchMux.Lock()
+	s.migrateCh <- target
+	err = <-s.migrateFinished
+	status = s.migrateState.finish(err)
+	s.switchMux.Unlock()
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
 		s.logger.Error("migration-failed", err)
+		s.writeJSON(w, http.StatusInternalServerError, status)
+		return
+	}
+
+	s.writeJSON(w, http.StatusOK, status)
+}
+
+// MigrationStatus reports the state of the last migration requested through
+// /migrate.
+func (s *httpServer) MigrationStatus(w http.ResponseWriter, req *http.Request) {
+	s.writeJSON(w, http.StatusOK, s.migrateState.current())
+}
+
+// migrationTarget returns the position in the binaries of the target in the
+// request body, or of the newest binary when the body names none.
+func (s *httpServer) migrationTarget(req *http.Request) (int, error) {
+	binaries := s.natsRunner.Binaries
+
+	body, err := io.ReadAll(io.LimitReader(req.Body, 4096))
+	if err != nil {
+		return 0, err
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		return binaries.Newest(), nil
+	}
+
+	var migrateRequest MigrateRequest
+	err = json.Unmarshal(body, &migrateRequest)
+	if err != nil {
+		return 0, fmt.Errorf("parsing migrate request: %w", err)
+	}
+	if migrateRequest.Target == "" {
+		return binaries.Newest(), nil
+	}
+
+	target, ok := binaries.Find(migrateRequest.Target)
+	if !ok {
+		return 0, fmt.Errorf("there is no nats binary called %s", migrateRequest.Target)
+	}
+	return target, nil
+}
+
+// Rollback returns the local nats to the binary before the current one. It
+// is refused while a migration or another rollback is in progress, and once
+// it succeeded the node can be migrated again.
+func (s *httpServer) Rollback(w http.ResponseWriter, req *http.Request) {
+	if !requirePost(w, req) {
+		return
+	}
+
+	requestedBy := clientIdentity(req)
+	s.logger.Info("received-rollback-api-call", lager.Data{"requested_by": requestedBy})
+
+	// beginRollback guards against a migration starting during the rollback
+	status, started := s.migrateState.beginRollback(requestedBy)
+	if !started {
+		s.logger.Info("skipping-rollback-switch-in-progress", lager.Data{"state": status.State, "target": status.Target})
+		s.writeJSON(w, http.StatusConflict, status)
+		return
+	}
+
+	s.switchMux.Lock()
+	defer s.switchMux.Unlock()
+
+	s.rollbackCh <- struct{}{}
+	err := <-s.rollbackFinished
+	s.migrateState.finishRollback(s.natsRunner.Status().Binary, err)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		s.logger.Error("rollback-failed", err)
 		// #nosec G104 - don't handle error writing http response. at best, we could log it and be susceptible to DoS's filling up disks with logs
 		w.Write(nil)
 		return
@@ -310,3 +1137,14 @@ func (s *httpServer) Migrate(w http.ResponseWriter, req *http.Request) {
 	// #nosec G104 - don't handle error writing http response. at best, we could log it and be susceptible to DoS's filling up disks with logs
 	w.Write(nil)
 }
+
+// requirePost answers requests with any other method with 405, so that a
+// plain GET or HEAD cannot switch the nats binary.
+func requirePost(w http.ResponseWriter, req *http.Request) bool {
+	if req.Method == http.MethodPost {
+		return true
+	}
+	w.Header().Set("Allow", http.MethodPost)
+	w.WriteHeader(http.StatusMethodNotAllowed)
+	return false
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/lager/v3"
+	"code.cloudfoundry.org/nats-v2-migrate/config"
+)
+
+const (
+	DefaultMemoryCheckInterval = 30 * time.Second
+
+	// MemoryAlertCycles is how many samples in a row have to be above the
+	// alert limit before it is logged, like monit's "for 2 cycles".
+	MemoryAlertCycles = 2
+)
+
+var memoryLimitFormat = regexp.MustCompile(`^([0-9]+) (B|KB|MB|GB|%)$`)
+
+var memoryUnits = map[string]uint64{
+	"B":  1,
+	"KB": 1 << 10,
+	"MB": 1 << 20,
+	"GB": 1 << 30,
+}
+
+// ParseMemoryLimit parses a limit in the "<number> B|KB|MB|GB|%" format of the
+// monit totalmem checks into bytes. Percentages are of totalMemory. An empty
+// limit is 0, which means no limit.
+func ParseMemoryLimit(limit string, totalMemory func() (uint64, error)) (uint64, error) {
+	if limit == "" {
+		return 0, nil
+	}
+
+	match := memoryLimitFormat.FindStringSubmatch(limit)
+	if match == nil {
+		return 0, fmt.Errorf("invalid memory limit %q, the format is <number> B|KB|MB|GB|%%", limit)
+	}
+	value, err := strconv.ParseUint(match[1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid memory limit %q: %w", limit, err)
+	}
+
+	if match[2] == "%" {
+		total, err := totalMemory()
+		if err != nil {
+			return 0, err
+		}
+		return total / 100 * value, nil
+	}
+	return value * memoryUnits[match[2]], nil
+}
+
+// MemoryWatchdog samples the resident memory of the nats the NATSRunner runs.
+// Above AlertLimit for MemoryAlertCycles samples it logs a warning. Above
+// RestartLimit it asks the NATSRunner through RestartCh to restart nats, which
+// drains the clients in lame duck mode instead of killing their connections.
+// A limit of 0 is not checked. An embedded nats shares the pid of the wrapper,
+// so in embedded mode the memory of the whole wrapper is measured.
+type MemoryWatchdog struct {
+	Logger       lager.Logger
+	NATSRunner   *NATSRunner
+	AlertLimit   uint64
+	RestartLimit uint64
+	Interval     time.Duration
+	RestartCh    chan<- struct{}
+}
+
+// NewMemoryWatchdog builds the watchdog from the config. It returns nil when
+// no memory limit is configured.
+func NewMemoryWatchdog(logger lager.Logger, cfg config.Config, natsRunner *NATSRunner, restartCh chan<- struct{}) (*MemoryWatchdog, error) {
+	alertLimit, err := ParseMemoryLimit(cfg.NATSMemLimitAlert, readTotalMemory)
+	if err != nil {
+		return nil, fmt.Errorf("nats_mem_limit_alert: %w", err)
+	}
+	restartLimit, err := ParseMemoryLimit(cfg.NATSMemLimitRestart, readTotalMemory)
+	if err != nil {
+		return nil, fmt.Errorf("nats_mem_limit_restart: %w", err)
+	}
+	if alertLimit == 0 && restartLimit == 0 {
+		return nil, nil
+	}
+
+	watchdog := &MemoryWatchdog{
+		Logger:       logger,
+		NATSRunner:   natsRunner,
+		AlertLimit:   alertLimit,
+		RestartLimit: restartLimit,
+		Interval:     DefaultMemoryCheckInterval,
+		RestartCh:    restartCh,
+	}
+	if cfg.NATSMemCheckInterval > 0 {
+		watchdog.Interval = time.Duration(cfg.NATSMemCheckInterval)
+	}
+	return watchdog, nil
+}
+
+func (w *MemoryWatchdog) Run(signals <-chan os.Signal, ready chan<- struct{}) error {
+	logger := w.Logger.Session("memory-watchdog")
+	logger.Info("watching", lager.Data{"alert_limit": w.AlertLimit, "restart_limit": w.RestartLimit, "interval": w.Interval.String()})
+
+	close(ready)
+
+	ticker := time.NewTicker(w.Interval)
+	defer ticker.Stop()
+
+	// every start of nats gets a new StartedAt, also in embedded mode where
+	// the pid stays the same
+	var startedAt, restartRequestedFor time.Time
+	var aboveAlert int
+	for {
+		select {
+		case <-signals:
+			return nil
+		case <-ticker.C:
+		}
+
+		status := w.NATSRunner.Status()
+		if !status.Running || status.StartedAt == nil {
+			continue
+		}
+		if !status.StartedAt.Equal(startedAt) {
+			startedAt, aboveAlert = *status.StartedAt, 0
+		}
+		pid := status.PID
+
+		rss, err := readRSS(pid)
+		if err != nil {
+			logger.Error("reading-nats-memory-failed", err, lager.Data{"pid": pid})
+			continue
+		}
+		data := lager.Data{"pid": pid, "rss": rss, "embedded": status.Embedded}
+
+		// nats keeps running until the runner got to the restart
+		if w.RestartLimit > 0 && rss > w.RestartLimit && !restartRequestedFor.Equal(startedAt) {
+			data["restart_limit"] = w.RestartLimit
+			logger.Info("memory-above-restart-limit", data)
+			restartRequestedFor = startedAt
+			select {
+			case w.RestartCh <- struct{}{}:
+			case <-signals:
+				return nil
+			}
+			continue
+		}
+
+		if w.AlertLimit == 0 {
+			continue
+		}
+		data["alert_limit"] = w.AlertLimit
+		if rss <= w.AlertLimit {
+			if aboveAlert >= MemoryAlertCycles {
+				logger.Info("memory-below-alert-limit", data)
+			}
+			aboveAlert = 0
+			continue
+		}
+		aboveAlert++
+		if aboveAlert == MemoryAlertCycles {
+			logger.Info("memory-above-alert-limit", data)
+		}
+	}
+}
+
+// readRSS returns the resident memory of pid in bytes from /proc/<pid>/status.
+func readRSS(pid int) (uint64, error) {
+	return readProcKB(filepath.Join("/proc", strconv.Itoa(pid), "status"), "VmRSS:")
+}
+
+func readTotalMemory() (uint64, error) {
+	return readProcKB("/proc/meminfo", "MemTotal:")
+}
+
+// readProcKB reads a "<key> <number> kB" line from a /proc file in bytes.
+func readProcKB(path, key string) (uint64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != key {
+			continue
+		}
+		kb, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("parsing %s in %s: %w", key, path, err)
+		}
+		return kb * 1024, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("no %s in %s", key, path)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"code.cloudfoundry.org/lager/v3"
+	"code.cloudfoundry.org/nats-v2-migrate/natsinfo"
+)
+
+const (
+	MetricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+var migrationStates = []string{
+	MigrationNotStarted,
+	MigrationNotNeeded,
+	MigrationInProgress,
+	MigrationSucceeded,
+	MigrationFailed,
+	RollbackInProgress,
+	RolledBack,
+	RollbackFailed,
+}
+
+// MetricsExporter serves the status of the wrapper and the monitoring data of
+// the local nats in the Prometheus text format. It polls /varz, /connz,
+// /routez and /subsz on every scrape, so the data is as fresh as the scrape.
+// Without a monitor port on the prober only the wrapper metrics are served.
+type MetricsExporter struct {
+	Logger         lager.Logger
+	Prober         *natsinfo.Prober
+	NATSMachineUrl string
+	NATSRunner     *NATSRunner
+}
+
+type natsMetrics struct {
+	stats  *natsinfo.ServerStats
+	connz  *natsinfo.Connz
+	routez *natsinfo.Routez
+	subsz  *natsinfo.Subsz
+}
+
+func (e *MetricsExporter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var m metricsWriter
+
+	status := e.NATSRunner.Status()
+	e.writeWrapperMetrics(&m, status)
+	if e.Prober.MonitorPort != 0 {
+		e.writeNATSMetrics(req.Context(), &m, status.Running)
+	}
+
+	w.Header().Set("Content-Type", MetricsContentType)
+	// #nosec G104 - don't handle error writing http response. at best, we could log it and be susceptible to DoS's filling up disks with logs
+	w.Write(m.Bytes())
+}
+
+func (e *MetricsExporter) writeWrapperMetrics(m *metricsWriter, status NATSStatus) {
+	m.gauge("nats_wrapper_nats_running", "Whether the wrapper runs a nats process.", boolValue(status.Running))
+	m.counter("nats_wrapper_nats_restarts_total", "Restarts of nats after it crashed.", float64(status.Restarts))
+	m.family("nats_wrapper_binary_info", "gauge", "The nats binary the wrapper runs.",
+		sample{labels: []string{"binary", status.Binary, "bin_path", status.BinPath}, value: 1})
+
+	var states []sample
+	for _, state := range migrationStates {
+		states = append(states, sample{labels: []string{"state", state}, value: boolValue(status.Migration == state)})
+	}
+	m.family("nats_wrapper_migration_state", "gauge", "The migration state of the node.", states...)
+}
+
+func (e *MetricsExporter) writeNATSMetrics(ctx context.Context, m *metricsWriter, running bool) {
+	if !running {
+		m.gauge("nats_up", "Whether the nats monitoring endpoints could be scraped.", 0)
+		return
+	}
+
+	metrics, err := e.scrape(ctx)
+	if err != nil {
+		e.Logger.Info("scraping-nats-failed", lager.Data{"error": err.Error()})
+		m.gauge("nats_up", "Whether the nats monitoring endpoints could be scraped.", 0)
+		return
+	}
+	m.gauge("nats_up", "Whether the nats monitoring endpoints could be scraped.", 1)
+
+	stats := metrics.stats
+	m.gauge("nats_server_connections", "Current client connections.", float64(stats.Connections))
+	m.counter("nats_server_connections_total", "Client connections since the server started.", float64(stats.TotalConnections))
+	m.counter("nats_server_in_msgs_total", "Messages received.", float64(stats.InMsgs))
+	m.counter("nats_server_out_msgs_total", "Messages sent.", float64(stats.OutMsgs))
+	m.counter("nats_server_in_bytes_total", "Bytes received.", float64(stats.InBytes))
+	m.counter("nats_server_out_bytes_total", "Bytes sent.", float64(stats.OutBytes))
+	m.counter("nats_server_slow_consumers_total", "Connections closed or marked as slow consumers.", float64(stats.SlowConsumers))
+	m.gauge("nats_server_mem_bytes", "Resident memory of the server.", float64(stats.Mem))
+	m.gauge("nats_server_cpu_percent", "CPU usage of the server.", stats.CPU)
+
+	// /connz lists up to 1024 connections by default
+	m.gauge("nats_server_pending_bytes", "Bytes buffered for the listed client connections.", float64(metrics.connz.PendingBytes()))
+
+	m.gauge("nats_server_routes", "Established routes.", float64(metrics.routez.NumRoutes))
+	m.gauge("nats_server_route_peers", "Peers with at least one established route.", float64(len(metrics.routez.RemoteIDs())))
+
+	subsz := metrics.subsz
+	m.gauge("nats_server_subscriptions", "Subscriptions in the routing table.", float64(subsz.NumSubs))
+	m.gauge("nats_server_subscriptions_cache_entries", "Entries in the subscription match cache.", float64(subsz.NumCache))
+	m.counter("nats_server_subscriptions_matches_total", "Subject matches against the routing table.", float64(subsz.NumMatches))
+	m.gauge("nats_server_subscriptions_cache_hit_ratio", "Share of matches served from the cache.", subsz.CacheHitRate)
+}
+
+// scrape reads all monitoring endpoints. Metrics from a partial scrape would
+// mix points in time, so any failure fails the scrape.
+func (e *MetricsExporter) scrape(ctx context.Context) (natsMetrics, error) {
+	var metrics natsMetrics
+	var err error
+
+	metrics.stats, err = e.Prober.GetServerStats(ctx, e.NATSMachineUrl)
+	if err != nil {
+		return metrics, err
+	}
+	metrics.connz, err = e.Prober.GetConnz(ctx, e.NATSMachineUrl)
+	if err != nil {
+		return metrics, err
+	}
+	metrics.routez, err = e.Prober.GetRoutez(ctx, e.NATSMachineUrl)
+	if err != nil {
+		return metrics, err
+	}
+	metrics.subsz, err = e.Prober.GetSubsz(ctx, e.NATSMachineUrl)
+	if err != nil {
+		return metrics, err
+	}
+
+	return metrics, nil
+}
+
+// sample is one line of a metric family. labels holds name and value pairs.
+type sample struct {
+	labels []string
+	value  float64
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// metricsWriter writes metric families in the Prometheus text format.
+type metricsWriter struct {
+	bytes.Buffer
+}
+
+func (m *metricsWriter) gauge(name, help string, value float64) {
+	m.family(name, "gauge", help, sample{value: value})
+}
+
+func (m *metricsWriter) counter(name, help string, value float64) {
+	m.family(name, "counter", help, sample{value: value})
+}
+
+func (m *metricsWriter) family(name, metricType, help string, samples ...sample) {
+	fmt.Fprintf(m, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(m, "# TYPE %s %s\n", name, metricType)
+	for _, s := range samples {
+		m.WriteString(name)
+		if len(s.labels) > 0 {
+			var labels []string
+			for i := 0; i+1 < len(s.labels); i += 2 {
+				labels = append(labels, fmt.Sprintf(`%s="%s"`, s.labels[i], labelValueEscaper.Replace(s.labels[i+1])))
+			}
+			fmt.Fprintf(m, "{%s}", strings.Join(labels, ","))
+		}
+		fmt.Fprintf(m, " %s\n", strconv.FormatFloat(s.value, 'g', -1, 64))
+	}
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
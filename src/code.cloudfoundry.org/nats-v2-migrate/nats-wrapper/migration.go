@@ -0,0 +1,125 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	MigrateStateIdle           = "idle"
+	MigrateStateInProgress     = "in-progress"
+	MigrateStateSucceeded      = "succeeded"
+	MigrateStateFailed         = "failed"
+	MigrateStateRollingBack    = "rolling-back"
+	MigrateStateRolledBack     = "rolled-back"
+	MigrateStateRollbackFailed = "rollback-failed"
+)
+
+// MigrateStatus describes the last migration requested through the migrate
+// server. It is served on /migrate/status and returned by POST /migrate.
+type MigrateStatus struct {
+	State       string     `json:"state"`
+	Target      string     `json:"target,omitempty"`
+	RequestedBy string     `json:"requested_by,omitempty"`
+	StartedAt   *time.Time `json:"started_at,omitempty"`
+	FinishedAt  *time.Time `json:"finished_at,omitempty"`
+	Error       string     `json:"error,omitempty"`
+}
+
+// migrateStateMachine moves between the MigrateState values. Only one
+// migration or rollback is in progress at a time; a migration that succeeded
+// is not repeated for the same target, while a failed one can be retried.
+type migrateStateMachine struct {
+	lock   sync.Mutex
+	status MigrateStatus
+}
+
+func newMigrateStateMachine() *migrateStateMachine {
+	return &migrateStateMachine{status: MigrateStatus{State: MigrateStateIdle}}
+}
+
+// begin moves to in-progress for target unless a migration or rollback is in
+// progress or a migration already succeeded for target. It returns the
+// resulting status and whether the caller has to perform the migration.
+func (m *migrateStateMachine) begin(target string, requestedBy string) (MigrateStatus, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	switch {
+	case m.busy():
+		return m.status, false
+	case m.status.State == MigrateStateSucceeded && m.status.Target == target:
+		return m.status, false
+	}
+
+	now := time.Now().UTC()
+	m.status = MigrateStatus{
+		State:       MigrateStateInProgress,
+		Target:      target,
+		RequestedBy: requestedBy,
+		StartedAt:   &now,
+	}
+	return m.status, true
+}
+
+// finish ends the migration in progress.
+func (m *migrateStateMachine) finish(err error) MigrateStatus {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	now := time.Now().UTC()
+	m.status.FinishedAt = &now
+	m.status.State = MigrateStateSucceeded
+	if err != nil {
+		m.status.State = MigrateStateFailed
+		m.status.Error = err.Error()
+	}
+	return m.status
+}
+
+// beginRollback moves to rolling-back unless a migration or rollback is in
+// progress. It returns the resulting status and whether the caller has to
+// perform the rollback.
+func (m *migrateStateMachine) beginRollback(requestedBy string) (MigrateStatus, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.busy() {
+		return m.status, false
+	}
+
+	now := time.Now().UTC()
+	m.status = MigrateStatus{
+		State:       MigrateStateRollingBack,
+		RequestedBy: requestedBy,
+		StartedAt:   &now,
+	}
+	return m.status, true
+}
+
+// finishRollback ends the rollback in progress on target, after which the
+// node can be migrated again.
+func (m *migrateStateMachine) finishRollback(target string, err error) MigrateStatus {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	now := time.Now().UTC()
+	m.status.FinishedAt = &now
+	m.status.Target = target
+	m.status.State = MigrateStateRolledBack
+	if err != nil {
+		m.status.State = MigrateStateRollbackFailed
+		m.status.Error = err.Error()
+	}
+	return m.status
+}
+
+func (m *migrateStateMachine) busy() bool {
+	return m.status.State == MigrateStateInProgress || m.status.State == MigrateStateRollingBack
+}
+
+func (m *migrateStateMachine) current() MigrateStatus {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.status
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager/v3"
+	"github.com/nats-io/nats-server/v2/server"
+)
+
+const (
+	natsLogTimeLayout = "2006/01/02 15:04:05.000000"
+)
+
+// natsLogLine matches the lines gnatsd and nats-server write, e.g.
+// "[7] 2024/01/02 15:04:05.000000 [INF] Server is ready". The pid and the
+// time are only written with the logtime option.
+var natsLogLine = regexp.MustCompile(`^(?:\[(\d+)\] )?(?:(\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2}\.\d{6}) )?\[(INF|WRN|ERR|FTL|DBG|TRC)\] (.*)$`)
+
+// natsVersionLine matches the startup lines that report the version of
+// nats-server and of gnatsd.
+var natsVersionLine = regexp.MustCompile(`^(?:\s*Version:\s+|Starting nats-server version )(\S+)$`)
+
+// natsLog re-emits the output of a nats binary as lager JSON with the level
+// and time nats logged it at, the binary it came from and the version nats
+// reported when it started.
+type natsLog struct {
+	logger lager.Logger
+	binary string
+
+	lock    sync.Mutex
+	version string
+	streams []*natsLogStream
+}
+
+func newNATSLog(logger lager.Logger, binary string) *natsLog {
+	return &natsLog{logger: logger, binary: binary}
+}
+
+// writer returns an io.Writer for one output stream of nats. Lines that are
+// not in the nats log format, such as a panic, are logged as errors when
+// they come from stderr.
+func (l *natsLog) writer(stderr bool) io.Writer {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	stream := &natsLogStream{log: l, stderr: stderr}
+	l.streams = append(l.streams, stream)
+	return stream
+}
+
+// Flush logs the unterminated last lines once nats exited.
+func (l *natsLog) Flush() {
+	l.lock.Lock()
+	streams := l.streams
+	l.lock.Unlock()
+
+	for _, stream := range streams {
+		stream.flush()
+	}
+}
+
+func (l *natsLog) logLine(line string, stderr bool) {
+	match := natsLogLine.FindStringSubmatch(line)
+	if match == nil {
+		data := l.data(lager.Data{"msg": line})
+		if stderr {
+			l.logger.Error("output", nil, data)
+			return
+		}
+		l.logger.Info("output", data)
+		return
+	}
+
+	data := lager.Data{"nats_level": match[3], "msg": match[4]}
+	if match[1] != "" {
+		data["pid"] = match[1]
+	}
+	if match[2] != "" {
+		loggedAt, err := time.ParseInLocation(natsLogTimeLayout, match[2], time.Local)
+		if err == nil {
+			data["nats_time"] = loggedAt.UTC().Format(time.RFC3339Nano)
+		}
+	}
+	l.log(match[3], match[4], data)
+}
+
+// log emits msg at the lager level matching level. nats only decides which
+// levels it writes, so its debug and trace lines are kept even when the
+// wrapper logs at info.
+func (l *natsLog) log(level string, msg string, data lager.Data) {
+	if version := natsVersionLine.FindStringSubmatch(msg); version != nil {
+		l.lock.Lock()
+		l.version = version[1]
+		l.lock.Unlock()
+	}
+	data = l.data(data)
+
+	switch level {
+	case "DBG", "TRC":
+		l.logger.Debug("output", data)
+	case "ERR", "FTL":
+		l.logger.Error("output", nil, data)
+	default:
+		l.logger.Info("output", data)
+	}
+}
+
+func (l *natsLog) data(data lager.Data) lager.Data {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	data["binary"] = l.binary
+	if l.version != "" {
+		data["version"] = l.version
+	}
+	return data
+}
+
+// natsLogStream splits one output stream of nats into lines.
+type natsLogStream struct {
+	log    *natsLog
+	stderr bool
+
+	lock    sync.Mutex
+	partial []byte
+}
+
+func (s *natsLogStream) Write(p []byte) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.partial = append(s.partial, p...)
+	for {
+		i := bytes.IndexByte(s.partial, '\n')
+		if i < 0 {
+			break
+		}
+		s.log.logLine(string(bytes.TrimSuffix(s.partial[:i], []byte("\r"))), s.stderr)
+		s.partial = s.partial[i+1:]
+	}
+
+	return len(p), nil
+}
+
+func (s *natsLogStream) flush() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if len(s.partial) > 0 {
+		s.log.logLine(string(s.partial), s.stderr)
+		s.partial = nil
+	}
+}
+
+// embeddedLogger passes the log statements of an EmbeddedNATS to a natsLog.
+type embeddedLogger struct {
+	log *natsLog
+}
+
+func (e embeddedLogger) Noticef(format string, v ...any) {
+	e.logf("INF", format, v...)
+}
+
+func (e embeddedLogger) Warnf(format string, v ...any) {
+	e.logf("WRN", format, v...)
+}
+
+// Fatalf exits like the nats-server logger does.
+func (e embeddedLogger) Fatalf(format string, v ...any) {
+	e.logf("FTL", format, v...)
+	os.Exit(1)
+}
+
+func (e embeddedLogger) Errorf(format string, v ...any) {
+	e.logf("ERR", format, v...)
+}
+
+func (e embeddedLogger) Debugf(format string, v ...any) {
+	e.logf("DBG", format, v...)
+}
+
+func (e embeddedLogger) Tracef(format string, v ...any) {
+	e.logf("TRC", format, v...)
+}
+
+func (e embeddedLogger) logf(level string, format string, v ...any) {
+	msg := fmt.Sprintf(format, v...)
+	e.log.log(level, msg, lager.Data{"nats_level": level, "msg": msg})
+}
+
+var _ server.Logger = embeddedLogger{}
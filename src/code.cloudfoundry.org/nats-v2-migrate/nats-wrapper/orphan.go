@@ -0,0 +1,179 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"code.cloudfoundry.org/lager/v3"
+	"code.cloudfoundry.org/nats-v2-migrate/config"
+)
+
+const (
+	OrphanPolicyTerminate = "terminate"
+	OrphanPolicyRefuse    = "refuse"
+
+	OrphanShutdownTimeout = 10 * time.Second
+	orphanPollInterval    = 100 * time.Millisecond
+)
+
+// OrphanedNATS is a nats started by a previous wrapper that is still running,
+// e.g. because that wrapper was killed before it could stop nats.
+type OrphanedNATS struct {
+	PID     int
+	BinPath string
+}
+
+// CheckOrphanedNATS looks for the nats recorded in pidFile. Depending on
+// policy it terminates it or returns an error, so that nats is never started
+// while an orphan holds its ports. A pidfile whose process is gone or is not
+// one of binaries is removed.
+func CheckOrphanedNATS(logger lager.Logger, pidFile string, policy string, binaries config.NATSBinaries, configPath string) error {
+	logger = logger.Session("orphan-check", lager.Data{"pid_file": pidFile})
+
+	if policy == "" {
+		policy = OrphanPolicyTerminate
+	}
+	if policy != OrphanPolicyTerminate && policy != OrphanPolicyRefuse {
+		return fmt.Errorf("invalid nats_orphan_policy %q, it must be %q or %q", policy, OrphanPolicyTerminate, OrphanPolicyRefuse)
+	}
+
+	orphan, err := findOrphanedNATS(pidFile, binaries, configPath)
+	if err != nil {
+		return err
+	}
+	if orphan == nil {
+		return removePidFile(pidFile, 0)
+	}
+
+	data := lager.Data{"pid": orphan.PID, "bin_path": orphan.BinPath, "policy": policy}
+	if policy == OrphanPolicyRefuse {
+		err := fmt.Errorf("nats %s from a previous wrapper is still running with pid %d, stop it before starting the wrapper", orphan.BinPath, orphan.PID)
+		logger.Error("refusing-to-start-next-to-orphaned-nats", err, data)
+		return err
+	}
+
+	logger.Info("terminating-orphaned-nats", data)
+	err = terminateOrphanedNATS(orphan.PID, OrphanShutdownTimeout)
+	if err != nil {
+		logger.Error("terminating-orphaned-nats-failed", err, data)
+		return err
+	}
+	logger.Info("terminated-orphaned-nats", data)
+	return removePidFile(pidFile, 0)
+}
+
+// findOrphanedNATS returns the process recorded in pidFile if it still runs
+// one of binaries with configPath. A pid that has been reused by another
+// process does not count.
+func findOrphanedNATS(pidFile string, binaries config.NATSBinaries, configPath string) (*OrphanedNATS, error) {
+	pid, err := readPidFile(pidFile)
+	if err != nil || pid == 0 {
+		return nil, err
+	}
+
+	args, err := processArgs(pid)
+	if err != nil || len(args) == 0 {
+		// the process is gone
+		return nil, nil
+	}
+
+	for _, binary := range binaries {
+		if runsBinary(args, binary.BinPath) && (configPath == "" || containsArg(args[1:], configPath)) {
+			return &OrphanedNATS{PID: pid, BinPath: binary.BinPath}, nil
+		}
+	}
+	return nil, nil
+}
+
+// runsBinary reports whether args are the command line of binPath. A script
+// runs as its interpreter with the script path as the first argument.
+func runsBinary(args []string, binPath string) bool {
+	return args[0] == binPath || (len(args) > 1 && args[1] == binPath)
+}
+
+// terminateOrphanedNATS interrupts the process like the wrapper stops nats
+// and kills it when it is still running after timeout.
+func terminateOrphanedNATS(pid int, timeout time.Duration) error {
+	err := syscall.Kill(pid, syscall.SIGINT)
+	if err != nil && !errors.Is(err, syscall.ESRCH) {
+		return err
+	}
+	if waitForProcessExit(pid, timeout) {
+		return nil
+	}
+
+	err = syscall.Kill(pid, syscall.SIGKILL)
+	if err != nil && !errors.Is(err, syscall.ESRCH) {
+		return err
+	}
+	if waitForProcessExit(pid, timeout) {
+		return nil
+	}
+	return fmt.Errorf("nats with pid %d is still running after SIGKILL", pid)
+}
+
+func waitForProcessExit(pid int, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		if !processRunning(pid) {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(orphanPollInterval)
+	}
+}
+
+func containsArg(args []string, arg string) bool {
+	for _, a := range args {
+		if a == arg {
+			return true
+		}
+	}
+	return false
+}
+
+// readPidFile returns 0 when there is no pidfile.
+func readPidFile(path string) (int, error) {
+	content, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	pid, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil {
+		return 0, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return pid, nil
+}
+
+func writePidFile(path string, pid int) error {
+	return os.WriteFile(path, []byte(strconv.Itoa(pid)+"\n"), 0644)
+}
+
+// removePidFile removes the pidfile if it records pid, or regardless of the
+// pid it records when pid is 0.
+func removePidFile(path string, pid int) error {
+	if pid != 0 {
+		recorded, err := readPidFile(path)
+		if err != nil || recorded != pid {
+			return err
+		}
+	}
+
+	err := os.Remove(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,48 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// childSysProcAttr asks the kernel to stop nats when the wrapper dies, so
+// that a killed wrapper does not leave nats holding its ports. The signal is
+// sent when the thread that started nats exits, so NewNATSSession starts nats
+// from a locked thread that lives as long as nats.
+func childSysProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Pdeathsig: syscall.SIGTERM}
+}
+
+// processArgs returns the command line of pid from /proc.
+func processArgs(pid int) ([]string, error) {
+	content, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "cmdline"))
+	if err != nil {
+		return nil, err
+	}
+
+	var args []string
+	for _, arg := range bytes.Split(bytes.TrimSuffix(content, []byte{0}), []byte{0}) {
+		args = append(args, string(arg))
+	}
+	return args, nil
+}
+
+// processRunning reports whether pid exists and is not a zombie.
+func processRunning(pid int) bool {
+	content, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return false
+	}
+
+	// the state follows the command name, which is in parentheses
+	i := bytes.LastIndexByte(content, ')')
+	if i < 0 || i+2 >= len(content) {
+		return false
+	}
+	return content[i+2] != 'Z'
+}
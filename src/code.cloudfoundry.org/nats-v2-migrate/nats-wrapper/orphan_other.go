@@ -0,0 +1,23 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// childSysProcAttr leaves stopping nats to the wrapper, Pdeathsig is Linux
+// only.
+func childSysProcAttr() *syscall.SysProcAttr {
+	return nil
+}
+
+// processArgs is not supported without /proc, so no orphan is ever found.
+func processArgs(pid int) ([]string, error) {
+	return nil, errors.New("reading the command line of a process is only supported on linux")
+}
+
+func processRunning(pid int) bool {
+	return syscall.Kill(pid, 0) == nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"code.cloudfoundry.org/lager/v3"
+	"code.cloudfoundry.org/nats-v2-migrate/config"
+	"code.cloudfoundry.org/nats-v2-migrate/natsinfo"
+)
+
+const (
+	// BinaryQuorumAllReachable starts the oldest binary any peer that answered
+	// runs.
+	BinaryQuorumAllReachable = "all-reachable"
+	// BinaryQuorumMajority starts the newest binary that more than half of the
+	// peers that answered run or are ahead of, so that a single peer cannot
+	// hold the node back.
+	BinaryQuorumMajority = "majority"
+
+	DefaultBinaryQuorumInterval = 5 * time.Second
+
+	peerUnreachable = "unreachable"
+)
+
+// BinaryQuorum decides which binary to start from the binaries the peers run.
+// Unless at least MinResponses peers answer it surveys them again every
+// Interval until Timeout has passed, and then fails.
+type BinaryQuorum struct {
+	Policy       string
+	MinResponses int
+	Timeout      time.Duration
+	Interval     time.Duration
+}
+
+// NewBinaryQuorum builds the quorum from the config for a cluster with peers
+// other instances.
+func NewBinaryQuorum(cfg config.Config, peers int) (BinaryQuorum, error) {
+	quorum := BinaryQuorum{
+		Policy:       cfg.NATSBinaryQuorum,
+		MinResponses: cfg.NATSBinaryMinResponses,
+		Timeout:      time.Duration(cfg.NATSBinaryQuorumTimeout),
+		Interval:     DefaultBinaryQuorumInterval,
+	}
+	if cfg.NATSBinaryQuorumInterval > 0 {
+		quorum.Interval = time.Duration(cfg.NATSBinaryQuorumInterval)
+	}
+
+	switch quorum.Policy {
+	case "":
+		quorum.Policy = BinaryQuorumAllReachable
+	case BinaryQuorumAllReachable, BinaryQuorumMajority:
+	default:
+		return BinaryQuorum{}, fmt.Errorf("invalid nats_binary_quorum %q, it must be %q or %q", quorum.Policy, BinaryQuorumAllReachable, BinaryQuorumMajority)
+	}
+	if quorum.MinResponses < 0 || quorum.MinResponses > peers {
+		return BinaryQuorum{}, fmt.Errorf("invalid nats_binary_min_responses %d, there are %d peers", quorum.MinResponses, peers)
+	}
+	return quorum, nil
+}
+
+// Select returns the binary to start for answers, the positions in binaries
+// of the binaries the peers run. Without answers it is newest.
+func (q BinaryQuorum) Select(answers []int, newest int) int {
+	if len(answers) == 0 {
+		return newest
+	}
+
+	sorted := append([]int(nil), answers...)
+	sort.Ints(sorted)
+	if q.Policy == BinaryQuorumMajority {
+		// a tie goes to the older binary
+		return sorted[(len(sorted)-1)/2]
+	}
+	return sorted[0]
+}
+
+// selectPeerBinary surveys peers until the quorum is met and returns the
+// binary it selects. The answer of every peer is logged in a single line.
+func selectPeerBinary(ctx context.Context, cfg config.Config, prober *natsinfo.Prober, peers []string, binaries config.NATSBinaries, logger lager.Logger) (int, error) {
+	quorum, err := NewBinaryQuorum(cfg, len(peers))
+	if err != nil {
+		return 0, err
+	}
+
+	deadline := time.Now().Add(quorum.Timeout)
+	for {
+		results := prober.Survey(ctx, peers, cfg.NATSProbeWorkers)
+		if ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+
+		answers, peerAnswers, err := peerBinaries(results, binaries)
+		if err != nil {
+			logger.Error("error-getting-nats-version", err)
+			return 0, err
+		}
+		data := lager.Data{"policy": quorum.Policy, "peers": peerAnswers, "responses": len(answers), "min_responses": quorum.MinResponses}
+
+		if len(answers) >= quorum.MinResponses {
+			if cfg.NATSClusterPort > 0 {
+				checkPeerRoutes(ctx, prober, cfg.NATSClusterPort, results, logger)
+			}
+
+			selected := quorum.Select(answers, binaries.Newest())
+			data["binary"] = binaries[selected].Name
+			logger.Info("selected-binary-from-peers", data)
+			return selected, nil
+		}
+
+		err = fmt.Errorf("%d of %d peers answered, %d are required", len(answers), len(peers), quorum.MinResponses)
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			logger.Error("too-few-peers-answered", err, data)
+			return 0, err
+		}
+		logger.Error("waiting-for-more-peers-to-answer", err, data)
+
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-time.After(min(quorum.Interval, remaining)):
+		}
+	}
+}
+
+// peerBinaries returns the binaries of the peers that answered, and what each
+// peer answered by instance for the log. Peers that cannot be reached or run a
+// version without a binary do not count as answers.
+func peerBinaries(results []natsinfo.SurveyResult, binaries config.NATSBinaries) ([]int, map[string]string, error) {
+	var answers []int
+	peerAnswers := map[string]string{}
+	for _, result := range results {
+		if result.Err != nil {
+			var connectErr *natsinfo.ErrConnectingToNATS
+			if errors.As(result.Err, &connectErr) {
+				peerAnswers[result.Instance] = peerUnreachable
+				continue
+			}
+			return nil, nil, result.Err
+		}
+
+		i, ok := binaries.ForVersion(result.Info.SemVer)
+		if !ok {
+			peerAnswers[result.Instance] = fmt.Sprintf("no binary for version %s", result.Version)
+			continue
+		}
+		peerAnswers[result.Instance] = binaries[i].Name
+		answers = append(answers, i)
+	}
+	return answers, peerAnswers, nil
+}
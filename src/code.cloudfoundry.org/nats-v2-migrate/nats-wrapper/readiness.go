@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"code.cloudfoundry.org/nats-v2-migrate/config"
+	"code.cloudfoundry.org/nats-v2-migrate/natsinfo"
+)
+
+const (
+	DefaultReadinessInterval = 500 * time.Millisecond
+)
+
+// ReadinessCheck waits for a freshly started nats to accept client
+// connections and answer PING. When ExpectedRoutes is set and the prober has
+// a monitor port, it also waits for routes to that many peers on /routez.
+type ReadinessCheck struct {
+	Prober         *natsinfo.Prober
+	NATSMachineUrl string
+	ExpectedRoutes int
+	Timeout        time.Duration
+	Interval       time.Duration
+}
+
+// NewReadinessCheck builds the readiness check from the config. It returns
+// nil when no readiness timeout is configured.
+func NewReadinessCheck(cfg config.Config) (*ReadinessCheck, error) {
+	if cfg.NATSReadinessTimeout <= 0 {
+		return nil, nil
+	}
+
+	prober, err := cfg.Prober()
+	if err != nil {
+		return nil, err
+	}
+	// Wait polls, so every check makes a single attempt
+	prober.Retries = 1
+	prober.Deadline = 0
+
+	expectedRoutes := len(cfg.NATSInstances) - 1
+	if expectedRoutes < 0 {
+		expectedRoutes = 0
+	}
+
+	return &ReadinessCheck{
+		Prober:         prober,
+		NATSMachineUrl: fmt.Sprintf("%s:%d", cfg.Address, cfg.NATSPort),
+		ExpectedRoutes: expectedRoutes,
+		Timeout:        time.Duration(cfg.NATSReadinessTimeout),
+		Interval:       DefaultReadinessInterval,
+	}, nil
+}
+
+// Wait polls nats until it is ready, it exits, or Timeout passes. The error
+// describes the last check that failed. Each check is only bounded by the
+// prober timeout, so that it is not cut short by the overall deadline. An
+// embedded nats is asked through the server API instead of being probed.
+func (c *ReadinessCheck) Wait(natsProcess NATSProcess) error {
+	deadline := time.NewTimer(c.Timeout)
+	defer deadline.Stop()
+
+	ticker := time.NewTicker(c.Interval)
+	defer ticker.Stop()
+
+	check := c.check
+	if embedded, ok := natsProcess.(*EmbeddedNATS); ok {
+		check = func(context.Context) error {
+			return embedded.checkReady(c.Interval, c.ExpectedRoutes)
+		}
+	}
+
+	for {
+		err := check(context.Background())
+		if err == nil {
+			return nil
+		}
+
+		select {
+		case <-natsProcess.Exited():
+			return fmt.Errorf("nats exited before it became ready: %w", err)
+		case <-deadline.C:
+			return fmt.Errorf("nats did not become ready within %s: %w", c.Timeout, err)
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *ReadinessCheck) check(ctx context.Context) error {
+	_, err := c.Prober.Ping(ctx, c.NATSMachineUrl)
+	if err != nil {
+		return err
+	}
+
+	if c.ExpectedRoutes == 0 || c.Prober.MonitorPort == 0 {
+		return nil
+	}
+
+	routez, err := c.Prober.GetRoutez(ctx, c.NATSMachineUrl)
+	if err != nil {
+		return err
+	}
+	established := len(routez.RemoteIDs())
+	if established < c.ExpectedRoutes {
+		return fmt.Errorf("%d of %d expected routes established", established, c.ExpectedRoutes)
+	}
+
+	return nil
+}
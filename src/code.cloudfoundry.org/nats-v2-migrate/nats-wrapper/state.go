@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	StateReasonMigrate  = "migrate-request"
+	StateReasonRollback = "rollback-request"
+)
+
+// MigrationState records which binary the node was last switched to, so that
+// a restarted wrapper keeps it instead of probing the peers again.
+type MigrationState struct {
+	Binary    string    `json:"binary"`
+	ChangedAt time.Time `json:"changed_at"`
+	Reason    string    `json:"reason"`
+}
+
+// LoadMigrationState reads the state file at path. It returns nil when no
+// state has been recorded.
+func LoadMigrationState(path string) (*MigrationState, error) {
+	content, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var state MigrationState
+	err = json.Unmarshal(content, &state)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	if state.Binary == "" {
+		return nil, fmt.Errorf("no binary recorded in %s", path)
+	}
+
+	return &state, nil
+}
+
+// Save writes the state to a temporary file next to path and renames it, so
+// that a crash never leaves a partial state file behind.
+func (s MigrationState) Save(path string) error {
+	content, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(content)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// ResetMigrationState removes the state file, so that the next start probes
+// the peers again.
+func ResetMigrationState(path string) error {
+	err := os.Remove(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	MigrationNotStarted = "not-started"
+	MigrationNotNeeded  = "not-needed"
+	MigrationInProgress = "in-progress"
+	MigrationSucceeded  = "migrated"
+	MigrationFailed     = "failed"
+	RollbackInProgress  = "rolling-back"
+	RolledBack          = "rolled-back"
+	RollbackFailed      = "rollback-failed"
+)
+
+// NATSStatus describes the nats process the wrapper runs. It is served on
+// the /status endpoint of the migrate server.
+type NATSStatus struct {
+	Binary       string     `json:"binary"`
+	BinPath      string     `json:"bin_path"`
+	Embedded     bool       `json:"embedded"`
+	Version      string     `json:"version,omitempty"`
+	Running      bool       `json:"running"`
+	PID          int        `json:"pid,omitempty"`
+	StartedAt    *time.Time `json:"started_at,omitempty"`
+	Uptime       string     `json:"uptime,omitempty"`
+	Restarts     int        `json:"restarts"`
+	Migration    string     `json:"migration"`
+	LastExitCode *int       `json:"last_exit_code"`
+}
+
+// natsState is the part of NATSStatus that the NATSRunner tracks while it
+// runs. It is read by the migrate server, so all access holds lock.
+type natsState struct {
+	lock         sync.Mutex
+	binary       string
+	binPath      string
+	embedded     bool
+	running      bool
+	pid          int
+	startedAt    time.Time
+	restarts     int
+	migration    string
+	lastExitCode *int
+}
+
+func (s *natsState) started(binary, binPath string, pid int, embedded bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.binary = binary
+	s.binPath = binPath
+	s.embedded = embedded
+	s.running = true
+	s.pid = pid
+	s.startedAt = time.Now()
+}
+
+func (s *natsState) exited(exitCode int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.running = false
+	s.pid = 0
+	s.lastExitCode = &exitCode
+}
+
+func (s *natsState) restarted() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.restarts++
+}
+
+func (s *natsState) setMigration(migration string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.migration = migration
+}
+
+func (s *natsState) status() NATSStatus {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	status := NATSStatus{
+		Binary:       s.binary,
+		BinPath:      s.binPath,
+		Embedded:     s.embedded,
+		Running:      s.running,
+		PID:          s.pid,
+		Restarts:     s.restarts,
+		Migration:    s.migration,
+		LastExitCode: s.lastExitCode,
+	}
+	if s.running {
+		startedAt := s.startedAt
+		status.StartedAt = &startedAt
+		status.Uptime = time.Since(startedAt).Round(time.Second).String()
+	}
+	return status
+}
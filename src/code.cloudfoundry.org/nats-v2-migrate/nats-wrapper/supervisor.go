@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/nats-v2-migrate/config"
+)
+
+const (
+	DefaultRestartInitialBackoff = time.Second
+	DefaultRestartMaxBackoff     = 30 * time.Second
+	DefaultRestartMaxRestarts    = 5
+	DefaultRestartWindow         = 5 * time.Minute
+
+	StderrTailLines = 20
+)
+
+// RestartPolicy decides how the wrapper restarts a nats process that
+// crashed. It allows MaxRestarts restarts within Window and waits between
+// them with exponential backoff from InitialBackoff up to MaxBackoff.
+type RestartPolicy struct {
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	MaxRestarts    int
+	Window         time.Duration
+
+	crashes []time.Time
+}
+
+// NewRestartPolicy builds the restart policy from the config. Settings that
+// are not set keep the defaults.
+func NewRestartPolicy(cfg config.Config) *RestartPolicy {
+	policy := &RestartPolicy{
+		InitialBackoff: DefaultRestartInitialBackoff,
+		MaxBackoff:     DefaultRestartMaxBackoff,
+		MaxRestarts:    DefaultRestartMaxRestarts,
+		Window:         DefaultRestartWindow,
+	}
+	if cfg.NATSRestartInitialBackoff > 0 {
+		policy.InitialBackoff = time.Duration(cfg.NATSRestartInitialBackoff)
+	}
+	if cfg.NATSRestartMaxBackoff > 0 {
+		policy.MaxBackoff = time.Duration(cfg.NATSRestartMaxBackoff)
+	}
+	if cfg.NATSRestartMaxRestarts > 0 {
+		policy.MaxRestarts = cfg.NATSRestartMaxRestarts
+	}
+	if cfg.NATSRestartWindow > 0 {
+		policy.Window = time.Duration(cfg.NATSRestartWindow)
+	}
+
+	return policy
+}
+
+// Crashed records a crash at now and returns how long to wait before the
+// next restart. It returns an error once the crashes within Window exceed
+// MaxRestarts.
+func (p *RestartPolicy) Crashed(now time.Time) (time.Duration, error) {
+	recent := p.crashes[:0]
+	for _, crash := range p.crashes {
+		if now.Sub(crash) < p.Window {
+			recent = append(recent, crash)
+		}
+	}
+	p.crashes = append(recent, now)
+
+	if len(p.crashes) > p.MaxRestarts {
+		return 0, fmt.Errorf("nats crashed %d times within %s", len(p.crashes), p.Window)
+	}
+
+	backoff := p.InitialBackoff
+	for i := 1; i < len(p.crashes) && backoff < p.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > p.MaxBackoff {
+		backoff = p.MaxBackoff
+	}
+
+	return backoff, nil
+}
+
+// lineTail is an io.Writer that keeps the last max lines written to it.
+type lineTail struct {
+	lock    sync.Mutex
+	max     int
+	lines   []string
+	partial []byte
+}
+
+func newLineTail(max int) *lineTail {
+	return &lineTail{max: max}
+}
+
+func (t *lineTail) Write(p []byte) (int, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.partial = append(t.partial, p...)
+	for {
+		i := bytes.IndexByte(t.partial, '\n')
+		if i < 0 {
+			break
+		}
+		t.lines = append(t.lines, string(t.partial[:i]))
+		t.partial = t.partial[i+1:]
+	}
+	if len(t.lines) > t.max {
+		t.lines = t.lines[len(t.lines)-t.max:]
+	}
+
+	return len(p), nil
+}
+
+// Lines returns the last lines written, including an unterminated last line.
+func (t *lineTail) Lines() []string {
+	if t == nil {
+		return nil
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	lines := append([]string{}, t.lines...)
+	if len(t.partial) > 0 {
+		lines = append(lines, string(t.partial))
+	}
+	if len(lines) > t.max {
+		lines = lines[len(lines)-t.max:]
+	}
+	return lines
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/nats-v2-migrate/config"
+	"code.cloudfoundry.org/nats-v2-migrate/natsinfo"
+	gnatsd "github.com/nats-io/gnatsd/server"
+	"github.com/nats-io/nats-server/v2/server"
+)
+
+const (
+	ConfigCheckTimeout = 10 * time.Second
+)
+
+// validateConfigFor checks the nats config the way binary will load it,
+// including the TLS certificates it references. An embedded binary is checked
+// with the vendored nats-server parser it runs with. Binaries whose version
+// constraint admits the vendored gnatsd are checked with the gnatsd parser, as
+// gnatsd has no flag to test a config. All other binaries check the config
+// themselves with -t, so that keys the vendored parser does not know yet are
+// accepted. nats-server reports the file, line and key of every error it
+// finds.
+func validateConfigFor(binary config.NATSBinary, configPath string, embedded bool) error {
+	if configPath == "" {
+		return nil
+	}
+
+	v1, err := natsinfo.ParseSemVer(gnatsd.VERSION)
+	if err != nil {
+		return err
+	}
+	switch {
+	case embedded:
+		_, err = server.ProcessConfigFile(configPath)
+	case binary.Matches(v1):
+		err = parseGNATSDConfig(configPath)
+	default:
+		err = checkConfigWithBinary(binary.BinPath, configPath)
+	}
+	if err != nil {
+		return fmt.Errorf("nats config is invalid for %s: %w", binary.Name, err)
+	}
+	return nil
+}
+
+// parseGNATSDConfig turns the panics the gnatsd parser raises for values of
+// the wrong type into errors.
+func parseGNATSDConfig(configPath string) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%s: %v", configPath, r)
+		}
+	}()
+
+	_, err = gnatsd.ProcessConfigFile(configPath)
+	return err
+}
+
+// checkConfigWithBinary runs binPath -t, which loads the config and exits
+// without starting the server. The error is what the binary printed.
+func checkConfigWithBinary(binPath, configPath string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), ConfigCheckTimeout)
+	defer cancel()
+
+	output, err := exec.CommandContext(ctx, binPath, "-t", "-c", configPath).CombinedOutput()
+	if err == nil {
+		return nil
+	}
+	if ctx.Err() != nil {
+		return fmt.Errorf("checking the config with %s timed out after %s", binPath, ConfigCheckTimeout)
+	}
+	var exitErr *exec.ExitError
+	if message := strings.TrimSpace(string(output)); errors.As(err, &exitErr) && message != "" {
+		return errors.New(message)
+	}
+	return fmt.Errorf("checking the config with %s: %w", binPath, err)
+}
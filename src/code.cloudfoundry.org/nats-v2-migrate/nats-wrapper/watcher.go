@@ -0,0 +1,205 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/lager/v3"
+	"github.com/nats-io/nats-server/v2/conf"
+)
+
+const (
+	DefaultConfigWatchInterval  = 5 * time.Second
+	DefaultConfigReloadDebounce = 2 * time.Second
+)
+
+// ConfigWatcher polls the nats config and the files it references, such as
+// TLS certificates. Once they have stopped changing for Debounce and the new
+// config is valid, it asks the NATSRunner to reload nats through ReloadCh.
+type ConfigWatcher struct {
+	Logger     lager.Logger
+	ConfigPath string
+	Interval   time.Duration
+	Debounce   time.Duration
+	ReloadCh   chan<- struct{}
+}
+
+func (w *ConfigWatcher) Run(signals <-chan os.Signal, ready chan<- struct{}) error {
+	logger := w.Logger.Session("config-watcher", lager.Data{"config_path": w.ConfigPath})
+
+	last := fingerprintNATSConfig(w.ConfigPath)
+	logger.Info("watching", lager.Data{"files": sortedKeys(last)})
+
+	close(ready)
+
+	ticker := time.NewTicker(w.Interval)
+	defer ticker.Stop()
+
+	pending := false
+	var changedAt time.Time
+	for {
+		select {
+		case <-signals:
+			return nil
+		case <-ticker.C:
+			current := fingerprintNATSConfig(w.ConfigPath)
+			if changed := changedFiles(last, current); len(changed) > 0 {
+				logger.Info("detected-change", lager.Data{"files": changed})
+				last = current
+				pending = true
+				changedAt = time.Now()
+				continue
+			}
+			if !pending || time.Since(changedAt) < w.Debounce {
+				continue
+			}
+			pending = false
+
+			err := validateNATSConfig(w.ConfigPath)
+			if err != nil {
+				logger.Error("skipping-reload-invalid-config", err)
+				continue
+			}
+
+			logger.Info("requesting-reload")
+			select {
+			case w.ReloadCh <- struct{}{}:
+			case <-signals:
+				return nil
+			}
+		}
+	}
+}
+
+// fingerprintNATSConfig returns a hash of the config and of every file it
+// references by path. Files that cannot be read are recorded as missing, so
+// that they count as changed once they appear.
+func fingerprintNATSConfig(configPath string) map[string]string {
+	files := []string{configPath}
+	parsed, err := conf.ParseFile(configPath)
+	if err == nil {
+		files = append(files, referencedFiles(parsed)...)
+	}
+
+	fingerprint := map[string]string{}
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			fingerprint[file] = "missing"
+			continue
+		}
+		sum := sha256.Sum256(content)
+		fingerprint[file] = hex.EncodeToString(sum[:])
+	}
+
+	return fingerprint
+}
+
+// tlsFileKeys are the keys of a tls block that reference the certificates
+// nats loads again when it reloads its config.
+var tlsFileKeys = []string{"ca_file", "cert_file", "key_file"}
+
+// referencedFiles collects the certificate files of the tls blocks, e.g. of
+// the client and the cluster listeners. Other files such as the log_file are
+// written by nats and must not trigger a reload.
+func referencedFiles(value any) []string {
+	var files []string
+	switch v := value.(type) {
+	case map[string]any:
+		for key, child := range v {
+			if block, ok := child.(map[string]any); ok && strings.EqualFold(key, "tls") {
+				for _, fileKey := range tlsFileKeys {
+					if path, ok := block[fileKey].(string); ok {
+						files = append(files, path)
+					}
+				}
+				continue
+			}
+			files = append(files, referencedFiles(child)...)
+		}
+	case []any:
+		for _, child := range v {
+			files = append(files, referencedFiles(child)...)
+		}
+	}
+	return files
+}
+
+// validateNATSConfig parses the config and loads the TLS certificates it
+// references, so that nats is not asked to reload a config it would reject.
+func validateNATSConfig(configPath string) error {
+	parsed, err := conf.ParseFile(configPath)
+	if err != nil {
+		return err
+	}
+	return validateTLSFiles(parsed)
+}
+
+func validateTLSFiles(value any) error {
+	switch v := value.(type) {
+	case map[string]any:
+		certFile, hasCert := v["cert_file"].(string)
+		keyFile, hasKey := v["key_file"].(string)
+		if hasCert || hasKey {
+			_, err := tls.LoadX509KeyPair(certFile, keyFile)
+			if err != nil {
+				return fmt.Errorf("loading key pair %s and %s: %w", certFile, keyFile, err)
+			}
+		}
+		if caFile, ok := v["ca_file"].(string); ok {
+			ca, err := os.ReadFile(caFile)
+			if err != nil {
+				return err
+			}
+			if !x509.NewCertPool().AppendCertsFromPEM(ca) {
+				return fmt.Errorf("no certificates found in %s", caFile)
+			}
+		}
+		for _, child := range v {
+			err := validateTLSFiles(child)
+			if err != nil {
+				return err
+			}
+		}
+	case []any:
+		for _, child := range v {
+			err := validateTLSFiles(child)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func changedFiles(last, current map[string]string) []string {
+	var changed []string
+	for file, sum := range current {
+		if last[file] != sum {
+			changed = append(changed, file)
+		}
+	}
+	for file := range last {
+		if _, ok := current[file]; !ok {
+			changed = append(changed, file)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,276 @@
+package natsinfo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	SourceClient  = "client"
+	SourceMonitor = "monitor"
+)
+
+// varz is the subset of the /varz monitoring endpoint that maps onto the
+// INFO block. gnatsd v1 and nats-server v2 both serve these fields.
+type varz struct {
+	ServerID     string   `json:"server_id"`
+	ServerName   string   `json:"server_name"`
+	Version      string   `json:"version"`
+	Proto        int      `json:"proto"`
+	GoVersion    string   `json:"go"`
+	Host         string   `json:"host"`
+	Port         int      `json:"port"`
+	TLSRequired  bool     `json:"tls_required"`
+	TLSVerify    bool     `json:"tls_verify"`
+	AuthRequired bool     `json:"auth_required"`
+	MaxPayload   int64    `json:"max_payload"`
+	ConnectURLs  []string `json:"connect_urls"`
+	Uptime       string   `json:"uptime"`
+	Cluster      struct {
+		Name string `json:"name"`
+	} `json:"cluster"`
+	JetStream struct {
+		Config *json.RawMessage `json:"config"`
+	} `json:"jetstream"`
+}
+
+// GetVarz reads the server information from the /varz monitoring endpoint
+// on MonitorPort of the host in natsMachineUrl. It makes a single attempt.
+func (p *Prober) GetVarz(ctx context.Context, natsMachineUrl string) (*NatsServerInfo, error) {
+	if p.MonitorPort == 0 {
+		return nil, fmt.Errorf("no monitor port configured")
+	}
+
+	var v varz
+	err := p.getMonitorJSON(ctx, natsMachineUrl, "/varz", &v)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &NatsServerInfo{
+		ServerID:     v.ServerID,
+		ServerName:   v.ServerName,
+		Version:      v.Version,
+		Proto:        v.Proto,
+		GoVersion:    v.GoVersion,
+		Host:         v.Host,
+		Port:         v.Port,
+		Cluster:      v.Cluster.Name,
+		TLSRequired:  v.TLSRequired,
+		TLSVerify:    v.TLSVerify,
+		AuthRequired: v.AuthRequired,
+		MaxPayload:   v.MaxPayload,
+		ConnectURLs:  v.ConnectURLs,
+		JetStream:    v.JetStream.Config != nil,
+		Uptime:       v.Uptime,
+		Source:       SourceMonitor,
+	}
+
+	info.SemVer, err = ParseSemVer(info.Version)
+	if err != nil {
+		return nil, err
+	}
+
+	return info, nil
+}
+
+// Routez is the subset of the /routez monitoring endpoint that tells which
+// peers a server has established routes to.
+type Routez struct {
+	NumRoutes int           `json:"num_routes"`
+	Routes    []RouteStatus `json:"routes"`
+}
+
+type RouteStatus struct {
+	RemoteID   string `json:"remote_id"`
+	IP         string `json:"ip"`
+	Port       int    `json:"port"`
+	DidSolicit bool   `json:"did_solicit"`
+}
+
+// RemoteIDs returns the distinct servers the routes lead to. nats-server 2.10
+// opens a pool of several routes to every peer.
+func (r *Routez) RemoteIDs() []string {
+	var ids []string
+	seen := map[string]bool{}
+	for _, route := range r.Routes {
+		if !seen[route.RemoteID] {
+			seen[route.RemoteID] = true
+			ids = append(ids, route.RemoteID)
+		}
+	}
+	return ids
+}
+
+// GetRoutez reads the established routes from the /routez monitoring endpoint
+// on MonitorPort of the host in natsMachineUrl. It makes a single attempt.
+func (p *Prober) GetRoutez(ctx context.Context, natsMachineUrl string) (*Routez, error) {
+	if p.MonitorPort == 0 {
+		return nil, fmt.Errorf("no monitor port configured")
+	}
+
+	var routez Routez
+	err := p.getMonitorJSON(ctx, natsMachineUrl, "/routez", &routez)
+	if err != nil {
+		return nil, err
+	}
+
+	return &routez, nil
+}
+
+// ServerStats is the subset of the /varz monitoring endpoint with the load
+// and traffic counters of a server.
+type ServerStats struct {
+	Connections      int     `json:"connections"`
+	TotalConnections uint64  `json:"total_connections"`
+	Routes           int     `json:"routes"`
+	Subscriptions    uint32  `json:"subscriptions"`
+	SlowConsumers    int64   `json:"slow_consumers"`
+	InMsgs           int64   `json:"in_msgs"`
+	OutMsgs          int64   `json:"out_msgs"`
+	InBytes          int64   `json:"in_bytes"`
+	OutBytes         int64   `json:"out_bytes"`
+	Mem              int64   `json:"mem"`
+	CPU              float64 `json:"cpu"`
+}
+
+// GetServerStats reads the counters from the /varz monitoring endpoint on
+// MonitorPort of the host in natsMachineUrl. It makes a single attempt.
+func (p *Prober) GetServerStats(ctx context.Context, natsMachineUrl string) (*ServerStats, error) {
+	if p.MonitorPort == 0 {
+		return nil, fmt.Errorf("no monitor port configured")
+	}
+
+	var stats ServerStats
+	err := p.getMonitorJSON(ctx, natsMachineUrl, "/varz", &stats)
+	if err != nil {
+		return nil, err
+	}
+
+	return &stats, nil
+}
+
+// Connz is the subset of the /connz monitoring endpoint that tells how much
+// the server buffers for its client connections.
+type Connz struct {
+	NumConns int          `json:"num_connections"`
+	Total    int          `json:"total"`
+	Conns    []ConnStatus `json:"connections"`
+}
+
+type ConnStatus struct {
+	CID           uint64 `json:"cid"`
+	PendingBytes  int    `json:"pending_bytes"`
+	Subscriptions uint32 `json:"subscriptions"`
+}
+
+// PendingBytes returns the bytes buffered for all listed connections.
+func (c *Connz) PendingBytes() int {
+	pending := 0
+	for _, conn := range c.Conns {
+		pending += conn.PendingBytes
+	}
+	return pending
+}
+
+// GetConnz reads the client connections from the /connz monitoring endpoint
+// on MonitorPort of the host in natsMachineUrl. It makes a single attempt.
+func (p *Prober) GetConnz(ctx context.Context, natsMachineUrl string) (*Connz, error) {
+	if p.MonitorPort == 0 {
+		return nil, fmt.Errorf("no monitor port configured")
+	}
+
+	var connz Connz
+	err := p.getMonitorJSON(ctx, natsMachineUrl, "/connz", &connz)
+	if err != nil {
+		return nil, err
+	}
+
+	return &connz, nil
+}
+
+// Subsz is the subset of the /subsz monitoring endpoint with the statistics
+// of the subscription routing table.
+type Subsz struct {
+	NumSubs      uint32  `json:"num_subscriptions"`
+	NumCache     uint32  `json:"num_cache"`
+	NumInserts   uint64  `json:"num_inserts"`
+	NumRemoves   uint64  `json:"num_removes"`
+	NumMatches   uint64  `json:"num_matches"`
+	CacheHitRate float64 `json:"cache_hit_rate"`
+}
+
+// GetSubsz reads the subscription statistics from the /subsz monitoring
+// endpoint on MonitorPort of the host in natsMachineUrl. It makes a single
+// attempt.
+func (p *Prober) GetSubsz(ctx context.Context, natsMachineUrl string) (*Subsz, error) {
+	if p.MonitorPort == 0 {
+		return nil, fmt.Errorf("no monitor port configured")
+	}
+
+	var subsz Subsz
+	err := p.getMonitorJSON(ctx, natsMachineUrl, "/subsz", &subsz)
+	if err != nil {
+		return nil, err
+	}
+
+	return &subsz, nil
+}
+
+// getMonitorJSON decodes the response to a GET request for path on the
+// monitoring port of the host in natsMachineUrl into v. The request is bounded
+// by Timeout and by the deadline of ctx, whichever comes first.
+func (p *Prober) getMonitorJSON(ctx context.Context, natsMachineUrl, path string, v any) error {
+	host, _, err := net.SplitHostPort(natsMachineUrl)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, p.timeout())
+	defer cancel()
+
+	resp, err := p.monitorGet(ctx, host, path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	err = json.NewDecoder(resp.Body).Decode(v)
+	if err != nil {
+		return fmt.Errorf("Error unmarshalling %s: %w", strings.TrimPrefix(path, "/"), err)
+	}
+	return nil
+}
+
+// monitorGet sends a GET request for path to the monitoring port of host.
+// The caller has to close the body of the response.
+func (p *Prober) monitorGet(ctx context.Context, host, path string) (*http.Response, error) {
+	scheme := "http"
+	client := &http.Client{}
+	if p.MonitorHTTPS {
+		scheme = "https"
+		client.Transport = &http.Transport{TLSClientConfig: p.TLSConfig}
+	}
+
+	url := fmt.Sprintf("%s://%s%s", scheme, net.JoinHostPort(host, strconv.Itoa(p.MonitorPort)), path)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status code from %s: %d", url, resp.StatusCode)
+	}
+
+	return resp, nil
+}
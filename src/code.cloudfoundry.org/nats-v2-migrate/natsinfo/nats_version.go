@@ -1,11 +1,8 @@
 package natsinfo
 
 import (
-	"bufio"
 	"encoding/json"
 	"fmt"
-	"net"
-	"strconv"
 	"strings"
 	"time"
 )
@@ -16,8 +13,31 @@ const (
 	NATSConnectionRetryInterval = 1 * time.Second
 )
 
+// NatsServerInfo is the INFO block a nats server sends to every client
+// right after the connection is established.
 type NatsServerInfo struct {
-	Version string `json:"version"`
+	ServerID     string   `json:"server_id"`
+	ServerName   string   `json:"server_name"`
+	Version      string   `json:"version"`
+	Proto        int      `json:"proto"`
+	GoVersion    string   `json:"go"`
+	Host         string   `json:"host"`
+	Port         int      `json:"port"`
+	Cluster      string   `json:"cluster,omitempty"`
+	TLSRequired  bool     `json:"tls_required"`
+	TLSVerify    bool     `json:"tls_verify"`
+	AuthRequired bool     `json:"auth_required"`
+	MaxPayload   int64    `json:"max_payload"`
+	ConnectURLs  []string `json:"connect_urls,omitempty"`
+	JetStream    bool     `json:"jetstream"`
+	// Uptime is only known when the info was read from the monitoring port.
+	Uptime string `json:"uptime,omitempty"`
+	// Source records whether the info came from the client port INFO block
+	// (SourceClient) or from the /varz monitoring endpoint (SourceMonitor).
+	Source string `json:"source"`
+
+	// SemVer is Version parsed as a semantic version.
+	SemVer SemVer `json:"-"`
 }
 
 type ErrConnectingToNATS struct {
@@ -28,43 +48,39 @@ func (e *ErrConnectingToNATS) Error() string {
 	return fmt.Sprintf("Error connecting: %v", e.err)
 }
 
+func (e *ErrConnectingToNATS) Unwrap() error {
+	return e.err
+}
+
 func GetMajorVersion(natsMachineUrl string) (int, error) {
-	conn, err := connectWithRetry(natsMachineUrl)
+	info, err := GetServerInfo(natsMachineUrl)
 	if err != nil {
-		return 0, &ErrConnectingToNATS{err}
-	}
-	status, err := bufio.NewReader(conn).ReadString('\n')
-	if err != nil {
-		return 0, fmt.Errorf("Error reading: %w", err)
+		return 0, err
 	}
 
-	serverJSON := strings.TrimPrefix(status, "INFO ")
+	return info.SemVer.Major, nil
+}
+
+// GetServerInfo connects to the nats server at natsMachineUrl and returns
+// the INFO block it announces.
+func GetServerInfo(natsMachineUrl string) (*NatsServerInfo, error) {
+	return GetServerInfoWithOptions(natsMachineUrl, ProbeOptions{})
+}
+
+// ParseServerInfo parses an "INFO {...}" protocol line.
+func ParseServerInfo(line string) (*NatsServerInfo, error) {
+	serverJSON := strings.TrimPrefix(strings.TrimSpace(line), "INFO ")
 	var natsServerInfo NatsServerInfo
-	err = json.Unmarshal([]byte(serverJSON), &natsServerInfo)
+	err := json.Unmarshal([]byte(serverJSON), &natsServerInfo)
 	if err != nil {
-		return 0, fmt.Errorf("Error unmarshalling json: %w", err)
-	}
-
-	semanticVersions := strings.Split(natsServerInfo.Version, ".")
-	if len(semanticVersions) < 3 {
-		return 0, fmt.Errorf("version is not normal semantic version: %w", err)
+		return nil, fmt.Errorf("Error unmarshalling json: %w", err)
 	}
 
-	majorVersion, err := strconv.Atoi(semanticVersions[0])
+	natsServerInfo.Source = SourceClient
+	natsServerInfo.SemVer, err = ParseSemVer(natsServerInfo.Version)
 	if err != nil {
-		return 0, fmt.Errorf("Error parsing semantic version: %w", err)
+		return nil, err
 	}
 
-	return majorVersion, nil
-}
-
-func connectWithRetry(natsMachineUrl string) (conn net.Conn, err error) {
-	for i := 0; i < NATSConnectionRetries; i++ {
-		conn, err = net.DialTimeout("tcp", natsMachineUrl, NATSConnectionTimeout)
-		if err == nil {
-			return conn, nil
-		}
-		time.Sleep(NATSConnectionRetryInterval)
-	}
-	return nil, err
+	return &natsServerInfo, nil
 }
@@ -0,0 +1,183 @@
+package natsinfo
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+var ErrTLSRequired = errors.New("server requires TLS but no TLS config was provided")
+
+type ErrTLSHandshake struct {
+	err error
+}
+
+func (e *ErrTLSHandshake) Error() string {
+	return fmt.Sprintf("Error performing TLS handshake: %v", e.err)
+}
+
+func (e *ErrTLSHandshake) Unwrap() error {
+	return e.err
+}
+
+// ErrServerRejected is returned when the server answers CONNECT or PING with
+// -ERR, e.g. because of an authorization violation.
+type ErrServerRejected struct {
+	Message string
+}
+
+func (e *ErrServerRejected) Error() string {
+	return fmt.Sprintf("server rejected connection: %s", e.Message)
+}
+
+// ProbeOptions controls how a probe talks to the server once the TCP
+// connection is established.
+type ProbeOptions struct {
+	// TLSConfig is used to upgrade the connection when the server announces
+	// tls_required, or straight away when TLSFirst is set.
+	TLSConfig *tls.Config
+	// TLSFirst performs the TLS handshake before the server sends INFO. The
+	// server has to be configured with handshake_first for this to work.
+	TLSFirst bool
+	User     string
+	Password string
+}
+
+type connectInfo struct {
+	Verbose     bool   `json:"verbose"`
+	Pedantic    bool   `json:"pedantic"`
+	TLSRequired bool   `json:"tls_required"`
+	Name        string `json:"name"`
+	Lang        string `json:"lang"`
+	Version     string `json:"version"`
+	Protocol    int    `json:"protocol"`
+	User        string `json:"user,omitempty"`
+	Pass        string `json:"pass,omitempty"`
+}
+
+// GetServerInfoWithOptions is like GetServerInfo but performs the TLS
+// handshake described by opts when the server requires it.
+func GetServerInfoWithOptions(natsMachineUrl string, opts ProbeOptions) (*NatsServerInfo, error) {
+	prober := NewProber()
+	prober.ProbeOptions = opts
+	return prober.GetServerInfo(context.Background(), natsMachineUrl)
+}
+
+// Ping reads the INFO block, upgrades to TLS if the server requires it, and
+// then sends CONNECT and PING. It succeeds once the server answers with PONG,
+// which means the server accepts client connections with these credentials.
+func Ping(natsMachineUrl string, opts ProbeOptions) (*NatsServerInfo, error) {
+	prober := NewProber()
+	prober.ProbeOptions = opts
+	return prober.Ping(context.Background(), natsMachineUrl)
+}
+
+func exchange(conn net.Conn, natsMachineUrl string, opts ProbeOptions, ping bool) (*NatsServerInfo, error) {
+	var err error
+	if opts.TLSFirst {
+		if opts.TLSConfig == nil {
+			return nil, ErrTLSRequired
+		}
+		conn, err = upgradeToTLS(conn, natsMachineUrl, opts.TLSConfig)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	reader := bufio.NewReader(conn)
+	status, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("Error reading: %w", err)
+	}
+
+	info, err := ParseServerInfo(status)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ping {
+		return info, nil
+	}
+
+	if info.TLSRequired && !opts.TLSFirst {
+		if opts.TLSConfig == nil {
+			return nil, ErrTLSRequired
+		}
+		conn, err = upgradeToTLS(conn, natsMachineUrl, opts.TLSConfig)
+		if err != nil {
+			return nil, err
+		}
+		reader = bufio.NewReader(conn)
+	}
+
+	err = sendConnectAndPing(conn, reader, info, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return info, nil
+}
+
+func upgradeToTLS(conn net.Conn, natsMachineUrl string, tlsConfig *tls.Config) (net.Conn, error) {
+	if tlsConfig.ServerName == "" {
+		host, _, err := net.SplitHostPort(natsMachineUrl)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.ServerName = host
+	}
+
+	tlsConn := tls.Client(conn, tlsConfig)
+	err := tlsConn.Handshake()
+	if err != nil {
+		return nil, &ErrTLSHandshake{err}
+	}
+
+	return tlsConn, nil
+}
+
+func sendConnectAndPing(conn net.Conn, reader *bufio.Reader, info *NatsServerInfo, opts ProbeOptions) error {
+	connect, err := json.Marshal(connectInfo{
+		TLSRequired: info.TLSRequired || opts.TLSFirst,
+		Name:        "natsinfo",
+		Lang:        "go",
+		Version:     info.Version,
+		Protocol:    1,
+		User:        opts.User,
+		Pass:        opts.Password,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(conn, "CONNECT %s\r\nPING\r\n", connect)
+	if err != nil {
+		return fmt.Errorf("Error writing: %w", err)
+	}
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("Error reading: %w", err)
+		}
+		line = strings.TrimSpace(line)
+
+		switch {
+		case line == "PONG":
+			return nil
+		case line == "PING":
+			_, err = fmt.Fprint(conn, "PONG\r\n")
+			if err != nil {
+				return fmt.Errorf("Error writing: %w", err)
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return &ErrServerRejected{Message: strings.TrimSpace(strings.TrimPrefix(line, "-ERR"))}
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package natsinfo
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"time"
+)
+
+// Prober probes nats servers, retrying failed connection attempts with an
+// exponential backoff until the retries or the deadline are exhausted.
+type Prober struct {
+	ProbeOptions
+
+	// Timeout bounds a single attempt, including the protocol exchange.
+	Timeout time.Duration
+	Retries int
+	// RetryInterval is the wait after the first failed attempt. It doubles
+	// after each further failure, up to MaxRetryInterval.
+	RetryInterval    time.Duration
+	MaxRetryInterval time.Duration
+	// Jitter randomizes each wait by up to this fraction of it, so that
+	// instances starting together do not probe in lockstep.
+	Jitter float64
+	// Deadline bounds the whole probe, across all attempts. Zero means the
+	// probe is only bounded by Retries and the context.
+	Deadline time.Duration
+
+	// MonitorPort is the monitoring port of the servers. When it is set and
+	// the client port cannot be probed, GetServerInfo falls back to /varz.
+	MonitorPort int
+	// MonitorHTTPS makes the monitoring requests use https with TLSConfig.
+	MonitorHTTPS bool
+
+	// RouteTLSConfig is the TLS config for route listeners that require TLS,
+	// which is separate from TLSConfig for the client port.
+	RouteTLSConfig *tls.Config
+}
+
+// NewProber returns a Prober with the package defaults, which retry at a
+// fixed interval of NATSConnectionRetryInterval.
+func NewProber() *Prober {
+	return &Prober{
+		Timeout:          NATSConnectionTimeout,
+		Retries:          NATSConnectionRetries,
+		RetryInterval:    NATSConnectionRetryInterval,
+		MaxRetryInterval: NATSConnectionRetryInterval,
+	}
+}
+
+// GetServerInfo reads the INFO block from the client port. When that fails
+// and MonitorPort is set, it reads the server information from /varz instead.
+// Deadline bounds both, so the fallback only gets what the client port left.
+func (p *Prober) GetServerInfo(ctx context.Context, natsMachineUrl string) (*NatsServerInfo, error) {
+	if p.Deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.Deadline)
+		defer cancel()
+	}
+
+	info, err := p.probe(ctx, natsMachineUrl, false)
+	if err == nil || p.MonitorPort == 0 || ctx.Err() != nil {
+		return info, err
+	}
+
+	info, monitorErr := p.GetVarz(ctx, natsMachineUrl)
+	if monitorErr != nil {
+		return nil, errors.Join(err, fmt.Errorf("falling back to the monitoring port: %w", monitorErr))
+	}
+
+	return info, nil
+}
+
+func (p *Prober) GetMajorVersion(ctx context.Context, natsMachineUrl string) (int, error) {
+	info, err := p.GetServerInfo(ctx, natsMachineUrl)
+	if err != nil {
+		return 0, err
+	}
+
+	return info.SemVer.Major, nil
+}
+
+// Ping is the Prober equivalent of the package level Ping.
+func (p *Prober) Ping(ctx context.Context, natsMachineUrl string) (*NatsServerInfo, error) {
+	return p.probe(ctx, natsMachineUrl, true)
+}
+
+func (p *Prober) probe(ctx context.Context, natsMachineUrl string, ping bool) (*NatsServerInfo, error) {
+	var info *NatsServerInfo
+	err := p.withConn(ctx, natsMachineUrl, func(conn net.Conn) error {
+		var err error
+		info, err = exchange(conn, natsMachineUrl, p.ProbeOptions, ping)
+		return err
+	})
+	return info, err
+}
+
+// withConn connects to natsMachineUrl, retrying as configured, and calls fn
+// with a connection whose deadline honors Timeout and ctx.
+func (p *Prober) withConn(ctx context.Context, natsMachineUrl string, fn func(net.Conn) error) error {
+	if p.Deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.Deadline)
+		defer cancel()
+	}
+
+	conn, err := p.connectWithRetry(ctx, natsMachineUrl)
+	if err != nil {
+		return &ErrConnectingToNATS{err}
+	}
+	defer conn.Close()
+
+	deadline := time.Now().Add(p.timeout())
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	// #nosec G104 - a failure to set the deadline surfaces as a read error later on
+	conn.SetDeadline(deadline)
+
+	stop := context.AfterFunc(ctx, func() {
+		// #nosec G104 - unblock pending reads when the context is cancelled
+		conn.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	return fn(conn)
+}
+
+func (p *Prober) connectWithRetry(ctx context.Context, natsMachineUrl string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: p.timeout()}
+	retries := p.retries()
+
+	var err error
+	for i := 0; i < retries; i++ {
+		var conn net.Conn
+		conn, err = dialer.DialContext(ctx, "tcp", natsMachineUrl)
+		if err == nil {
+			return conn, nil
+		}
+
+		if i == retries-1 {
+			break
+		}
+
+		t := time.NewTimer(p.backoff(i))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return nil, fmt.Errorf("%w after %d attempts: %v", ctx.Err(), i+1, err)
+		case <-t.C:
+		}
+	}
+	return nil, err
+}
+
+// timeout is Timeout, or NATSConnectionTimeout when it is not set, so that a
+// zero Prober does not time out right away.
+func (p *Prober) timeout() time.Duration {
+	if p.Timeout <= 0 {
+		return NATSConnectionTimeout
+	}
+	return p.Timeout
+}
+
+// retries is Retries, but at least one attempt.
+func (p *Prober) retries() int {
+	return max(p.Retries, 1)
+}
+
+func (p *Prober) backoff(attempt int) time.Duration {
+	maxWait := max(p.MaxRetryInterval, p.RetryInterval)
+	wait := p.RetryInterval
+	for i := 0; i < attempt && wait < maxWait; i++ {
+		wait *= 2
+	}
+	wait = min(wait, maxWait)
+
+	if p.Jitter > 0 {
+		// #nosec G404 - jitter does not need a cryptographically secure source
+		delta := (rand.Float64()*2 - 1) * p.Jitter * float64(wait)
+		wait += time.Duration(delta)
+	}
+
+	return wait
+}
@@ -0,0 +1,77 @@
+package natsinfo
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// RouteInfo is the INFO block a nats server sends on its cluster port to
+// servers that connect to it as a route.
+type RouteInfo struct {
+	ServerID     string `json:"server_id"`
+	ServerName   string `json:"server_name"`
+	Version      string `json:"version"`
+	Host         string `json:"host"`
+	Port         int    `json:"port"`
+	Cluster      string `json:"cluster,omitempty"`
+	TLSRequired  bool   `json:"tls_required"`
+	TLSVerify    bool   `json:"tls_verify"`
+	AuthRequired bool   `json:"auth_required"`
+}
+
+// GetRouteInfo reads the INFO block from the cluster port at routeUrl. A
+// nats-server v2 route listener that requires TLS only sends INFO after the
+// TLS handshake, which is done with RouteTLSConfig when it is set. gnatsd
+// sends INFO before the handshake, so probe it without RouteTLSConfig.
+func (p *Prober) GetRouteInfo(ctx context.Context, routeUrl string) (*RouteInfo, error) {
+	var info RouteInfo
+	err := p.withConn(ctx, routeUrl, func(conn net.Conn) error {
+		if p.RouteTLSConfig != nil {
+			tlsConn := tls.Client(conn, routeTLSConfig(p.RouteTLSConfig, routeUrl))
+			err := tlsConn.HandshakeContext(ctx)
+			if err != nil {
+				return fmt.Errorf("TLS handshake with the route listener: %w", err)
+			}
+			conn = tlsConn
+		}
+
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("Error reading: %w", err)
+		}
+		if !strings.HasPrefix(line, "INFO ") {
+			return fmt.Errorf("unexpected route protocol line: %q", strings.TrimSpace(line))
+		}
+
+		err = json.Unmarshal([]byte(strings.TrimPrefix(strings.TrimSpace(line), "INFO ")), &info)
+		if err != nil {
+			return fmt.Errorf("Error unmarshalling json: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &info, nil
+}
+
+// routeTLSConfig verifies the route listener against its host unless config
+// names the server.
+func routeTLSConfig(config *tls.Config, routeUrl string) *tls.Config {
+	if config.ServerName != "" {
+		return config
+	}
+	host, _, err := net.SplitHostPort(routeUrl)
+	if err != nil {
+		return config
+	}
+	config = config.Clone()
+	config.ServerName = host
+	return config
+}
@@ -0,0 +1,227 @@
+package natsinfo
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// SemVer is a semantic version as described on https://semver.org.
+type SemVer struct {
+	Major      int
+	Minor      int
+	Patch      int
+	PreRelease []string
+	Build      string
+}
+
+// ParseSemVer parses MAJOR.MINOR.PATCH with optional pre-release and build
+// metadata, e.g. "2.10.22-beta.1+build". A leading "v" is accepted.
+func ParseSemVer(version string) (SemVer, error) {
+	v, parts, err := parseVersion(version)
+	if err != nil {
+		return SemVer{}, err
+	}
+	if parts < 3 {
+		return SemVer{}, fmt.Errorf("version is not normal semantic version: %q", version)
+	}
+
+	return v, nil
+}
+
+// parseVersion parses a possibly partial version such as "3" or "2.10" and
+// returns how many of major, minor and patch were given. Missing components
+// are zero.
+func parseVersion(version string) (SemVer, int, error) {
+	rest := strings.TrimPrefix(strings.TrimSpace(version), "v")
+
+	var v SemVer
+	rest, v.Build, _ = strings.Cut(rest, "+")
+	rest, preRelease, hasPreRelease := strings.Cut(rest, "-")
+	if hasPreRelease {
+		v.PreRelease = strings.Split(preRelease, ".")
+		for _, identifier := range v.PreRelease {
+			if identifier == "" {
+				return SemVer{}, 0, fmt.Errorf("version has an empty pre-release identifier: %q", version)
+			}
+		}
+	}
+
+	core := strings.Split(rest, ".")
+	if len(core) > 3 {
+		return SemVer{}, 0, fmt.Errorf("version is not normal semantic version: %q", version)
+	}
+
+	numbers := []*int{&v.Major, &v.Minor, &v.Patch}
+	for i, component := range core {
+		n, err := strconv.Atoi(component)
+		if err != nil || n < 0 {
+			return SemVer{}, 0, fmt.Errorf("Error parsing semantic version %q: invalid component %q", version, component)
+		}
+		*numbers[i] = n
+	}
+
+	return v, len(core), nil
+}
+
+func (v SemVer) String() string {
+	s := fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+	if len(v.PreRelease) > 0 {
+		s += "-" + strings.Join(v.PreRelease, ".")
+	}
+	if v.Build != "" {
+		s += "+" + v.Build
+	}
+	return s
+}
+
+// Compare returns -1, 0 or +1 depending on whether v has lower, equal or
+// higher precedence than other. Build metadata does not affect precedence.
+func (v SemVer) Compare(other SemVer) int {
+	for _, c := range [][2]int{{v.Major, other.Major}, {v.Minor, other.Minor}, {v.Patch, other.Patch}} {
+		if c[0] != c[1] {
+			return compareInts(c[0], c[1])
+		}
+	}
+
+	// A version without pre-release identifiers is higher than one with.
+	switch {
+	case len(v.PreRelease) == 0 && len(other.PreRelease) == 0:
+		return 0
+	case len(v.PreRelease) == 0:
+		return 1
+	case len(other.PreRelease) == 0:
+		return -1
+	}
+
+	for i := 0; i < len(v.PreRelease) && i < len(other.PreRelease); i++ {
+		c := comparePreReleaseIdentifiers(v.PreRelease[i], other.PreRelease[i])
+		if c != 0 {
+			return c
+		}
+	}
+	return compareInts(len(v.PreRelease), len(other.PreRelease))
+}
+
+func (v SemVer) LessThan(other SemVer) bool {
+	return v.Compare(other) < 0
+}
+
+func (v SemVer) Equal(other SemVer) bool {
+	return v.Compare(other) == 0
+}
+
+func comparePreReleaseIdentifiers(a, b string) int {
+	aNum, aErr := strconv.Atoi(a)
+	bNum, bErr := strconv.Atoi(b)
+
+	switch {
+	case aErr == nil && bErr == nil:
+		return compareInts(aNum, bNum)
+	case aErr == nil:
+		// numeric identifiers have lower precedence than alphanumeric ones
+		return -1
+	case bErr == nil:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+func compareInts(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// Constraint is a version policy such as ">=2.10.0 <3". Comparisons
+// separated by spaces must all hold; alternatives are separated by "||".
+// Versions in a constraint may be partial, so "<3" means "<3.0.0".
+type Constraint struct {
+	raw          string
+	alternatives [][]comparison
+}
+
+type comparison struct {
+	operator string
+	version  SemVer
+}
+
+var operators = []string{">=", "<=", "!=", "==", ">", "<", "="}
+
+func ParseConstraint(constraint string) (Constraint, error) {
+	c := Constraint{raw: strings.TrimSpace(constraint)}
+
+	for _, alternative := range strings.Split(constraint, "||") {
+		fields := strings.Fields(alternative)
+		if len(fields) == 0 {
+			return Constraint{}, fmt.Errorf("constraint %q has an empty alternative", constraint)
+		}
+
+		var comparisons []comparison
+		for _, field := range fields {
+			operator := "="
+			for _, op := range operators {
+				if strings.HasPrefix(field, op) {
+					operator = op
+					break
+				}
+			}
+			versionString := strings.TrimPrefix(field, operator)
+			if operator == "==" {
+				operator = "="
+			}
+
+			version, _, err := parseVersion(versionString)
+			if err != nil {
+				return Constraint{}, fmt.Errorf("constraint %q: %w", constraint, err)
+			}
+			comparisons = append(comparisons, comparison{operator: operator, version: version})
+		}
+		c.alternatives = append(c.alternatives, comparisons)
+	}
+
+	return c, nil
+}
+
+// Check reports whether v satisfies the constraint.
+func (c Constraint) Check(v SemVer) bool {
+	for _, comparisons := range c.alternatives {
+		if allHold(comparisons, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c Constraint) String() string {
+	return c.raw
+}
+
+func allHold(comparisons []comparison, v SemVer) bool {
+	for _, cmp := range comparisons {
+		result := v.Compare(cmp.version)
+		var holds bool
+		switch cmp.operator {
+		case "=":
+			holds = result == 0
+		case "!=":
+			holds = result != 0
+		case ">":
+			holds = result > 0
+		case ">=":
+			holds = result >= 0
+		case "<":
+			holds = result < 0
+		case "<=":
+			holds = result <= 0
+		}
+		if !holds {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,135 @@
+package natsinfo
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+const DefaultSurveyWorkers = 8
+
+// ErrorClass groups probe failures so that a survey can be summarized.
+type ErrorClass string
+
+const (
+	ErrorClassNone        ErrorClass = ""
+	ErrorClassUnreachable ErrorClass = "unreachable"
+	ErrorClassTimeout     ErrorClass = "timeout"
+	ErrorClassCancelled   ErrorClass = "cancelled"
+	ErrorClassTLS         ErrorClass = "tls"
+	ErrorClassRejected    ErrorClass = "rejected"
+	ErrorClassProtocol    ErrorClass = "protocol"
+)
+
+// SurveyResult is the outcome of probing a single instance.
+type SurveyResult struct {
+	Instance   string          `json:"instance"`
+	Reachable  bool            `json:"reachable"`
+	Version    string          `json:"version,omitempty"`
+	Info       *NatsServerInfo `json:"info,omitempty"`
+	Latency    time.Duration   `json:"latency_ns"`
+	ErrorClass ErrorClass      `json:"error_class,omitempty"`
+	Error      string          `json:"error,omitempty"`
+
+	Err error `json:"-"`
+}
+
+// Survey probes all instances concurrently with at most workers probes in
+// flight and returns one result per instance, in the order of instances.
+func (p *Prober) Survey(ctx context.Context, instances []string, workers int) []SurveyResult {
+	if workers <= 0 {
+		workers = DefaultSurveyWorkers
+	}
+
+	results := make([]SurveyResult, len(instances))
+	indexes := make(chan int)
+	wg := sync.WaitGroup{}
+
+	for w := 0; w < workers && w < len(instances); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				results[i] = p.surveyInstance(ctx, instances[i])
+			}
+		}()
+	}
+
+	for i := range instances {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	return results
+}
+
+func (p *Prober) surveyInstance(ctx context.Context, instance string) SurveyResult {
+	start := time.Now()
+	info, err := p.GetServerInfo(ctx, instance)
+	result := SurveyResult{
+		Instance: instance,
+		Latency:  time.Since(start),
+		Info:     info,
+		Err:      err,
+	}
+
+	if err != nil {
+		result.ErrorClass = ClassifyError(err)
+		result.Error = err.Error()
+		// the server answered but we could not make sense of it
+		result.Reachable = result.ErrorClass == ErrorClassProtocol
+		return result
+	}
+
+	result.Reachable = true
+	result.Version = info.Version
+	return result
+}
+
+// ClassifyError maps an error returned by a probe to an ErrorClass.
+func ClassifyError(err error) ErrorClass {
+	if err == nil {
+		return ErrorClassNone
+	}
+
+	var netErr net.Error
+	var connectErr *ErrConnectingToNATS
+	var tlsErr *ErrTLSHandshake
+	var rejectedErr *ErrServerRejected
+
+	switch {
+	case errors.Is(err, context.Canceled):
+		return ErrorClassCancelled
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return ErrorClassTimeout
+	case errors.As(err, &connectErr):
+		return ErrorClassUnreachable
+	case errors.As(err, &tlsErr), errors.Is(err, ErrTLSRequired):
+		return ErrorClassTLS
+	case errors.As(err, &rejectedErr):
+		return ErrorClassRejected
+	}
+	return ErrorClassProtocol
+}
+
+// IsMixedVersion reports whether the instances that answered a survey run
+// different versions.
+func IsMixedVersion(results []SurveyResult) bool {
+	var first *SemVer
+	for _, result := range results {
+		if result.Info == nil {
+			continue
+		}
+		if first == nil {
+			first = &result.Info.SemVer
+			continue
+		}
+		if !first.Equal(result.Info.SemVer) {
+			return true
+		}
+	}
+	return false
+}